@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -14,10 +15,17 @@ const (
 	messagesFile     = "messages.json"
 )
 
+// Guards read-modify-write cycles on the integrations file
+var integrationsMutex sync.Mutex
+
 // Credentials
 type Teams struct {
 	TenantID   string        `json:"tenant_id,omitempty"`
 	OAuthToken *oauth2.Token `json:"oauth_token,omitempty"`
+	TokenKey   string        `json:"token_key,omitempty"` // Key of the token in the encrypted token store
+	TeamID     string        `json:"team_id,omitempty"`
+	ChannelID  string        `json:"channel_id,omitempty"`
+	ServiceURL string        `json:"service_url,omitempty"`
 }
 
 // Define integrationProps
@@ -62,6 +70,8 @@ type TeamsMessageRequest struct {
 	TeamsUserEmail string `json:"teamsUserEmail"`
 	Message        string `json:"message,omitempty"`
 	Context        string `json:"context"`
+	ConversationID string `json:"conversationId,omitempty"`
+	Sender         string `json:"sender,omitempty"`
 }
 
 // Other existing structs
@@ -92,28 +102,13 @@ type GraphToken struct {
 	ExpiresAt   time.Time
 }
 
-// Activity struct for cards
-type Activity struct {
-	Type         string    `json:"type"`
-	Timestamp    time.Time `json:"timestamp"`
-	From         User      `json:"from"`
-	Conversation struct {
-		ID string `json:"id"`
-	} `json:"conversation"`
-	Value struct {
-		UserQuestion string `json:"userQuestion"`
-	} `json:"value"`
-}
-
-type User struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-}
-
 // New functions for handling integrations and messages
 
 // Adds a new integration to the database
 func AddIntegration(req IntegrationRequest) error {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+
 	integrations, err := readIntegrations()
 	if err != nil {
 		return err
@@ -125,6 +120,9 @@ func AddIntegration(req IntegrationRequest) error {
 
 // updates an existing integration in the database
 func UpdateIntegration(req IntegrationRequest, integrationUuid string) error {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+
 	integrations, err := readIntegrations()
 	if err != nil {
 		return err
@@ -140,13 +138,125 @@ func UpdateIntegration(req IntegrationRequest, integrationUuid string) error {
 	return fmt.Errorf("integration not found")
 }
 
-// sends teams messages
-func SendTeamsMessage(req TeamsMessageRequest) error {
-	messages, err := readMessages()
+// Finds the integration of a tenant, returning nil when the tenant has not connected
+func FindIntegration(tenantID string) (*IntegrationRequest, error) {
+	return findIntegrationWhere(func(teams *Teams) bool {
+		return teams.TenantID == tenantID
+	})
+}
+
+// Finds the integration whose Reports channel is channelID
+func FindIntegrationByChannel(channelID string) (*IntegrationRequest, error) {
+	return findIntegrationWhere(func(teams *Teams) bool {
+		return teams.ChannelID == channelID
+	})
+}
+
+// ListIntegrations returns every connected tenant
+func ListIntegrations() ([]IntegrationRequest, error) {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+
+	return readIntegrations()
+}
+
+// Returns the first integration matching the given condition
+func findIntegrationWhere(match func(teams *Teams) bool) (*IntegrationRequest, error) {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+
+	integrations, i, err := findIntegrationLocked(match)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	return &integrations[i], nil
+}
+
+// Reads the integrations and returns them with the index of the first one matching the
+// given condition, or -1 when none does. The caller must hold integrationsMutex.
+func findIntegrationLocked(match func(teams *Teams) bool) ([]IntegrationRequest, int, error) {
+	integrations, err := readIntegrations()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	for i, integration := range integrations {
+		if integration.Integration != nil && integration.Integration.Teams != nil && match(integration.Integration.Teams) {
+			return integrations, i, nil
+		}
+	}
+
+	return integrations, -1, nil
+}
+
+// Creates or updates the integration of a tenant. Empty fields in teams keep their stored value.
+// The lookup, merge and write happen under one lock so concurrent saves cannot lose fields
+// or add a second record for the tenant.
+func SaveTenantIntegration(teams Teams) error {
+	integrationsMutex.Lock()
+	defer integrationsMutex.Unlock()
+
+	integrations, i, err := findIntegrationLocked(func(existing *Teams) bool {
+		return existing.TenantID == teams.TenantID
+	})
 	if err != nil {
 		return err
 	}
 
+	if i < 0 {
+		integrations = append(integrations, IntegrationRequest{
+			Integration: &Integration{
+				Uuid:  teams.TenantID,
+				Teams: &teams,
+				Props: integrationProps{LastSyncTime: time.Now()},
+			},
+			Remark: "Microsoft Teams",
+		})
+		return writeIntegrations(integrations)
+	}
+
+	existing := integrations[i].Integration
+	merged := *existing.Teams
+	if teams.TokenKey != "" {
+		merged.TokenKey = teams.TokenKey
+	}
+	if teams.TeamID != "" {
+		merged.TeamID = teams.TeamID
+	}
+	if teams.ChannelID != "" {
+		merged.ChannelID = teams.ChannelID
+	}
+	if teams.ServiceURL != "" {
+		merged.ServiceURL = teams.ServiceURL
+	}
+
+	existing.Teams = &merged
+	existing.Props.LastSyncTime = time.Now()
+	return writeIntegrations(integrations)
+}
+
+// Stores the serviceUrl of an inbound activity on its tenant's integration
+func updateTenantServiceURL(activity Activity) error {
+	tenantID := activity.TenantID()
+	if tenantID == "" || activity.ServiceURL == "" {
+		return nil
+	}
+
+	existing, err := FindIntegration(tenantID)
+	if err != nil || existing == nil || existing.Integration.Teams.ServiceURL == activity.ServiceURL {
+		return err
+	}
+
+	return SaveTenantIntegration(Teams{TenantID: tenantID, ServiceURL: activity.ServiceURL})
+}
+
+// sends teams messages
+func SendTeamsMessage(req TeamsMessageRequest) error {
+	sender := req.Sender
+	if sender == "" {
+		sender = "Bot"
+	}
+
 	message := TeamsMessageRow{
 		EventTime:      time.Now(),
 		CaseNumber:     req.CaseNumber,
@@ -155,37 +265,37 @@ func SendTeamsMessage(req TeamsMessageRequest) error {
 		TeamsUserId:    req.TeamsUserId,
 		TeamsUserEmail: req.TeamsUserEmail,
 		Message:        req.Message,
-		Sender:         "Bot",
+		Sender:         sender,
 		IsIntended:     nil,
 		ResponseStatus: "Sent",
 	}
 
-	messages = append(messages, message)
-	return writeMessages(messages)
+	// Number the message within its conversation when we know which one it belongs to
+	if req.ConversationID != "" {
+		return messageStore.Record(req.ConversationID, "", &message, false)
+	}
+	return messageStore.Append(&message)
 }
 
-// Reads the messages from user
-func RecordUserMessage(activity Activity) error {
-	messages, err := readMessages()
-	if err != nil {
-		return err
-	}
+// Reads the messages from user, opening a new case when the message is a new question
+func RecordUserMessage(activity Activity, text string, newCase bool) (*TeamsMessageRow, error) {
+	profile := getUserProfile(activity)
 
 	message := TeamsMessageRow{
 		EventTime:      activity.Timestamp,
-		CaseNumber:     0, // Fetch from database
-		ThreadNumber:   0,
-		MessageNumber:  0,
 		TeamsUserId:    activity.From.ID,
-		TeamsUserEmail: "", //Fetch from user profile
-		Message:        activity.Value.UserQuestion,
+		TeamsUserEmail: profile.Email,
+		Message:        text,
 		Sender:         "User",
 		IsIntended:     nil,
 		ResponseStatus: "Received",
 	}
 
-	messages = append(messages, message)
-	return writeMessages(messages)
+	err := messageStore.Record(activity.Conversation.ID, activity.TenantID(), &message, newCase)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
 }
 
 // Read integrations
@@ -211,10 +321,10 @@ func writeIntegrations(integrations []IntegrationRequest) error {
 	return os.WriteFile(integrationsFile, data, 0644)
 }
 
-// Read messages
-func readMessages() ([]TeamsMessageRow, error) {
+// Read messages from a legacy messages.json file
+func readMessagesFile(path string) ([]TeamsMessageRow, error) {
 	var messages []TeamsMessageRow
-	data, err := os.ReadFile(messagesFile)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return messages, nil
@@ -224,12 +334,3 @@ func readMessages() ([]TeamsMessageRow, error) {
 	err = json.Unmarshal(data, &messages)
 	return messages, err
 }
-
-// Write messages
-func writeMessages(messages []TeamsMessageRow) error {
-	data, err := json.MarshalIndent(messages, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(messagesFile, data, 0644)
-}
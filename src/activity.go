@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Activity types sent by the Bot Connector
+const (
+	activityTypeMessage            = "message"
+	activityTypeConversationUpdate = "conversationUpdate"
+	activityTypeMessageReaction    = "messageReaction"
+	activityTypeInstallationUpdate = "installationUpdate"
+	activityTypeTyping             = "typing"
+	activityTypeInvoke             = "invoke"
+)
+
+// Activity sent to the bot by the Bot Connector
+type Activity struct {
+	Type             string            `json:"type"`
+	ID               string            `json:"id,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	Timestamp        time.Time         `json:"timestamp"`
+	LocalTimestamp   time.Time         `json:"localTimestamp,omitempty"`
+	ServiceURL       string            `json:"serviceUrl"`
+	ChannelID        string            `json:"channelId,omitempty"`
+	From             User              `json:"from"`
+	Recipient        User              `json:"recipient"`
+	Conversation     Conversation      `json:"conversation"`
+	ReplyToID        string            `json:"replyToId,omitempty"`
+	Text             string            `json:"text,omitempty"`
+	TextFormat       string            `json:"textFormat,omitempty"`
+	Locale           string            `json:"locale,omitempty"`
+	Entities         []Entity          `json:"entities,omitempty"`
+	Attachments      []json.RawMessage `json:"attachments,omitempty"`
+	MembersAdded     []User            `json:"membersAdded,omitempty"`
+	MembersRemoved   []User            `json:"membersRemoved,omitempty"`
+	ReactionsAdded   []MessageReaction `json:"reactionsAdded,omitempty"`
+	ReactionsRemoved []MessageReaction `json:"reactionsRemoved,omitempty"`
+	Action           string            `json:"action,omitempty"` // "add" or "remove" on installationUpdate
+	Value            ActivityValue     `json:"value"`
+	ChannelData      ChannelData       `json:"channelData"`
+}
+
+// Conversation an activity belongs to
+type Conversation struct {
+	ID               string `json:"id"`
+	Name             string `json:"name,omitempty"`
+	ConversationType string `json:"conversationType,omitempty"` // "personal", "groupChat" or "channel"
+	TenantID         string `json:"tenantId,omitempty"`
+	IsGroup          bool   `json:"isGroup,omitempty"`
+}
+
+// Value of an activity. Card submissions and invokes fill the typed fields, Raw always holds
+// the original JSON for activities whose value has another shape.
+type ActivityValue struct {
+	UserQuestion string `json:"userQuestion"`
+	CardAction   string `json:"cardAction"`
+	Verb         string `json:"verb"`
+	ReportID     string `json:"reportId"`
+	AnalystReply string `json:"analystReply"`
+	CaseNumber   int    `json:"caseNumber"`
+	CloseCase    bool   `json:"closeCase"`
+	From         string `json:"from"`     // Asker shown on a forwarded question card
+	Question     string `json:"question"` // Question shown on a forwarded question card
+	// Set on adaptiveCard/action invoke activities
+	Action *CardAction `json:"action,omitempty"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON keeps the raw value and tolerates values that don't match the typed fields
+func (v *ActivityValue) UnmarshalJSON(data []byte) error {
+	type plain ActivityValue
+	var value plain
+	err := json.Unmarshal(data, &value)
+
+	var typeErr *json.UnmarshalTypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		value = plain{}
+	}
+
+	*v = ActivityValue(value)
+	v.Raw = append(json.RawMessage{}, data...)
+	return nil
+}
+
+// Entity attached to an activity, such as a mention
+type Entity struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	Mentioned *User  `json:"mentioned,omitempty"`
+}
+
+// Reaction added to or removed from a message
+type MessageReaction struct {
+	Type string `json:"type"`
+}
+
+// Teams specific channel data of an activity
+type ChannelData struct {
+	EventType string `json:"eventType,omitempty"`
+	Tenant    struct {
+		ID string `json:"id"`
+	} `json:"tenant"`
+	Team struct {
+		ID         string `json:"id"`
+		Name       string `json:"name,omitempty"`
+		AADGroupID string `json:"aadGroupId,omitempty"`
+	} `json:"team"`
+	Channel struct {
+		ID   string `json:"id"`
+		Name string `json:"name,omitempty"`
+	} `json:"channel"`
+}
+
+// Account of a user or bot in a conversation
+type User struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	AADObjectID string `json:"aadObjectId,omitempty"`
+}
+
+// TenantID returns the tenant of the activity from its channel data or conversation
+func (a Activity) TenantID() string {
+	if a.ChannelData.Tenant.ID != "" {
+		return a.ChannelData.Tenant.ID
+	}
+	return a.Conversation.TenantID
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+)
+
+// Handles one kind of activity. A non-nil response is written as the body of the HTTP response.
+type ActivityHandler func(activity Activity) *InvokeResponse
+
+// Dispatches activities to the handler registered for their type and name
+type ActivityRouter struct {
+	handlers map[string]ActivityHandler
+}
+
+// Global variables
+var (
+	activityRouter = newBotActivityRouter()
+)
+
+// NewActivityRouter creates a router without any handlers
+func NewActivityRouter() *ActivityRouter {
+	return &ActivityRouter{handlers: make(map[string]ActivityHandler)}
+}
+
+// Handle registers the handler for every activity of the given type
+func (r *ActivityRouter) Handle(activityType string, handler ActivityHandler) {
+	r.handlers[activityType] = handler
+}
+
+// HandleNamed registers the handler for activities of the given type and name, such as invokes
+func (r *ActivityRouter) HandleNamed(activityType, name string, handler ActivityHandler) {
+	r.handlers[activityType+"/"+name] = handler
+}
+
+// Dispatch runs the most specific handler for the activity. It reports false when no handler is registered.
+func (r *ActivityRouter) Dispatch(activity Activity) (*InvokeResponse, bool) {
+	handler, ok := r.handlers[activity.Type+"/"+activity.Name]
+	if !ok || activity.Name == "" {
+		handler, ok = r.handlers[activity.Type]
+	}
+	if !ok {
+		return nil, false
+	}
+	return handler(activity), true
+}
+
+// newBotActivityRouter registers the bot's handlers
+func newBotActivityRouter() *ActivityRouter {
+	router := NewActivityRouter()
+	router.Handle(activityTypeMessage, handleMessageActivity)
+	router.HandleNamed(activityTypeInvoke, "adaptiveCard/action", func(activity Activity) *InvokeResponse {
+		response := handleAdaptiveCardAction(activity)
+		return &response
+	})
+	router.Handle(activityTypeConversationUpdate, handleConversationUpdate)
+	router.Handle(activityTypeInstallationUpdate, handleInstallationUpdate)
+	router.Handle(activityTypeMessageReaction, handleMessageReaction)
+	router.Handle(activityTypeTyping, func(activity Activity) *InvokeResponse {
+		return nil
+	})
+	return router
+}
+
+// handleMessageReaction logs reactions to the bot's messages
+func handleMessageReaction(activity Activity) *InvokeResponse {
+	for _, reaction := range activity.ReactionsAdded {
+		log.Printf("User %s reacted %s to %s", activity.From.Name, reaction.Type, activity.ReplyToID)
+	}
+	for _, reaction := range activity.ReactionsRemoved {
+		log.Printf("User %s removed reaction %s from %s", activity.From.Name, reaction.Type, activity.ReplyToID)
+	}
+	return nil
+}
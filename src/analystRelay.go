@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// forwardQuestionToAnalysts posts a user question to the tenant's Reports channel with a reply box.
+// Questions on the same case are grouped in one channel thread.
+func forwardQuestionToAnalysts(activity Activity, row *TeamsMessageRow, question string) {
+	tenantID := activity.TenantID()
+	channelID, err := getReportsChannelID(tenantID)
+	if err != nil {
+		log.Printf("Cannot forward question of case %d: %v", row.CaseNumber, err)
+		return
+	}
+
+	profile := getUserProfile(activity)
+	card := createAnalystQuestionCard(row.CaseNumber, profile, question)
+	_, _, err = postCaseActivity(tenantID, questionThreadID(row.CaseNumber), channelID, card)
+	if err != nil {
+		log.Printf("Failed to forward question of case %d: %v", row.CaseNumber, err)
+	}
+}
+
+// JSON format for a user question forwarded to analysts
+func createAnalystQuestionCard(caseNumber int, profile *UserProfile, question string) map[string]interface{} {
+	from := profile.Name
+	if profile.Email != "" {
+		from = fmt.Sprintf("%s (%s)", profile.Name, profile.Email)
+	}
+
+	replyAction := func(title string, closeCase bool) map[string]interface{} {
+		return map[string]interface{}{
+			"type":  "Action.Submit",
+			"title": title,
+			"data": map[string]interface{}{
+				"cardAction": "analystReply",
+				"caseNumber": caseNumber,
+				"closeCase":  closeCase,
+				"from":       from,
+				"question":   question,
+			},
+		}
+	}
+
+	body := append(questionCardBody(caseNumber, from, question), map[string]interface{}{
+		"type":        "Input.Text",
+		"id":          "analystReply",
+		"placeholder": "Type your reply to the user...",
+		"isMultiline": true,
+	})
+	return questionCard(body, []map[string]interface{}{
+		replyAction("Reply", false),
+		replyAction("Reply and close case", true),
+	})
+}
+
+// JSON format for a question that has been answered. It replaces the question card so the reply cannot be sent twice.
+func createAnsweredQuestionCard(caseNumber int, from, question, analyst, reply string, closed bool) map[string]interface{} {
+	status := fmt.Sprintf("Answered by %s", analyst)
+	if closed {
+		status += ", case closed"
+	}
+
+	body := append(questionCardBody(caseNumber, from, question),
+		map[string]interface{}{
+			"type":      "TextBlock",
+			"text":      status,
+			"weight":    "bolder",
+			"color":     "good",
+			"separator": true,
+			"wrap":      true,
+		},
+		map[string]interface{}{
+			"type": "TextBlock",
+			"text": reply,
+			"wrap": true,
+		},
+	)
+	return questionCard(body, nil)
+}
+
+// Text blocks describing a user question
+func questionCardBody(caseNumber int, from, question string) []map[string]interface{} {
+	return []map[string]interface{}{
+		{
+			"type":   "TextBlock",
+			"text":   fmt.Sprintf("User Question - Case #%d", caseNumber),
+			"weight": "bolder",
+			"size":   "medium",
+		},
+		{
+			"type":     "TextBlock",
+			"text":     fmt.Sprintf("From: %s", from),
+			"isSubtle": true,
+			"wrap":     true,
+		},
+		{
+			"type": "TextBlock",
+			"text": question,
+			"wrap": true,
+		},
+	}
+}
+
+// Wraps the body and actions of a question card in a message
+func questionCard(body, actions []map[string]interface{}) map[string]interface{} {
+	content := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.0",
+		"body":    body,
+	}
+	if len(actions) > 0 {
+		content["actions"] = actions
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{
+			{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content":     content,
+			},
+		},
+	}
+}
+
+// checkAnalystChannel makes sure a reply comes from the Reports channel of the tenant that owns the case
+func checkAnalystChannel(activity Activity, record *CaseRecord) error {
+	if record.TenantID == "" || activity.TenantID() != record.TenantID {
+		return fmt.Errorf("reply comes from tenant %q, not the tenant of the case", activity.TenantID())
+	}
+
+	channelID, err := getReportsChannelID(record.TenantID)
+	if err != nil {
+		return err
+	}
+	if activity.ChannelData.Channel.ID != channelID {
+		return fmt.Errorf("reply was not sent from the tenant's Reports channel")
+	}
+	return nil
+}
+
+// handleAnalystReply relays an analyst's reply to the user who asked and records it on the case
+func handleAnalystReply(activity Activity) {
+	caseNumber := activity.Value.CaseNumber
+	reply := strings.TrimSpace(activity.Value.AnalystReply)
+	if reply == "" {
+		log.Printf("Received empty reply for case %d, ignoring", caseNumber)
+		return
+	}
+
+	record, err := messageStore.GetCase(caseNumber)
+	if err != nil {
+		log.Printf("Failed to load case %d: %v", caseNumber, err)
+		return
+	}
+	if record == nil {
+		log.Printf("Analyst reply for unknown case %d", caseNumber)
+		return
+	}
+	if err := checkAnalystChannel(activity, record); err != nil {
+		log.Printf("Rejected reply for case %d from %s: %v", caseNumber, activity.From.Name, err)
+		return
+	}
+
+	// The user's chat lives in the same tenant and region as the analyst's channel
+	rememberConversationServiceURL(record.ConversationID, activity.ServiceURL)
+
+	message := fmt.Sprintf("**%s** from Culminate Security replied to your question (case #%d):\n\n%s", activity.From.Name, caseNumber, reply)
+	err = sendBotMessage(record.ConversationID, message)
+	if err != nil {
+		log.Printf("Failed to relay reply for case %d: %v", caseNumber, err)
+		notifyAnalyst(activity, fmt.Sprintf("Your reply to case #%d could not be delivered: %v", caseNumber, err))
+		return
+	}
+
+	// The reply is recorded with the email of the user who asked, usually cached from their question
+	ownerEmail := ""
+	owner, err := lookupUserProfile(record.ConversationID, record.TenantID, record.TeamsUserId)
+	if err == nil {
+		ownerEmail = owner.Email
+	}
+
+	err = SendTeamsMessage(TeamsMessageRequest{
+		CaseNumber:     caseNumber,
+		TeamsUserId:    record.TeamsUserId,
+		TeamsUserEmail: ownerEmail,
+		Message:        reply,
+		Context:        "Analyst reply to user question",
+		ConversationID: record.ConversationID,
+		Sender:         "Analyst: " + activity.From.Name,
+	})
+	if err != nil {
+		log.Printf("Failed to record analyst reply for case %d: %v", caseNumber, err)
+	}
+
+	closed := false
+	status := fmt.Sprintf("Reply sent to the user by **%s**.", activity.From.Name)
+	if activity.Value.CloseCase {
+		err = messageStore.CloseCase(caseNumber)
+		if err != nil {
+			log.Printf("Failed to close case %d: %v", caseNumber, err)
+		} else {
+			closed = true
+			status = fmt.Sprintf("Reply sent to the user and case #%d closed by **%s**.", caseNumber, activity.From.Name)
+		}
+	}
+
+	// Replace the question card so the reply buttons cannot send the reply again
+	if activity.ReplyToID != "" {
+		card := createAnsweredQuestionCard(caseNumber, activity.Value.From, activity.Value.Question, activity.From.Name, reply, closed)
+		err = updateActivity(activity.Conversation.ID, activity.ReplyToID, card)
+		if err != nil {
+			log.Printf("Failed to update question card of case %d: %v", caseNumber, err)
+		}
+	}
+
+	notifyAnalyst(activity, status)
+}
+
+// notifyAnalyst posts a status note in the thread where the analyst replied
+func notifyAnalyst(activity Activity, text string) {
+	err := sendBotMessage(activity.Conversation.ID, text)
+	if err != nil {
+		log.Printf("Failed to notify analyst %s: %v", activity.From.Name, err)
+	}
+}
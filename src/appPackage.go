@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Fields of the Teams app manifest packaged in APP_ZIP
+type appManifest struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	Name    struct {
+		Short string `json:"short"`
+	} `json:"name"`
+}
+
+// readAppManifest reads manifest.json from the root of a Teams app package
+func readAppManifest(appZipPath string) (*appManifest, error) {
+	archive, err := zip.OpenReader(appZipPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open app package file: %w", err)
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if !strings.EqualFold(file.Name, "manifest.json") {
+			continue
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open manifest: %w", err)
+		}
+		defer reader.Close()
+
+		var manifest appManifest
+		err = json.NewDecoder(reader).Decode(&manifest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		}
+		if manifest.ID == "" || manifest.Version == "" {
+			return nil, fmt.Errorf("manifest is missing id or version")
+		}
+		return &manifest, nil
+	}
+
+	return nil, fmt.Errorf("app package has no manifest.json")
+}
+
+// compareVersions compares dotted numeric versions such as "1.2.10", returning -1, 0 or 1.
+// Missing parts count as zero and parts that are not numbers are compared as text.
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+
+		aNum, aErr := strconv.Atoi(aPart)
+		bNum, bErr := strconv.Atoi(bPart)
+		switch {
+		case aErr == nil && bErr == nil && aNum != bNum:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && aPart != bPart:
+			return strings.Compare(aPart, bPart)
+		}
+	}
+	return 0
+}
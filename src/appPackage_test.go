@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestPackage writes a zip containing the given files and returns its path
+func writeTestPackage(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "app.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for name, content := range files {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadAppManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			files: map[string]string{
+				"manifest.json": `{"id": "app-1", "version": "1.2.3", "name": {"short": "Culminate Security"}}`,
+				"color.png":     "png",
+			},
+		},
+		{
+			name:  "upper case file name",
+			files: map[string]string{"Manifest.json": `{"id": "app-1", "version": "1.2.3", "name": {"short": "Culminate Security"}}`},
+		},
+		{
+			name:    "no manifest",
+			files:   map[string]string{"color.png": "png"},
+			wantErr: "no manifest.json",
+		},
+		{
+			name:    "manifest in a folder",
+			files:   map[string]string{"app/manifest.json": `{"id": "app-1", "version": "1.2.3"}`},
+			wantErr: "no manifest.json",
+		},
+		{
+			name:    "invalid JSON",
+			files:   map[string]string{"manifest.json": `{"id": `},
+			wantErr: "failed to parse manifest",
+		},
+		{
+			name:    "missing version",
+			files:   map[string]string{"manifest.json": `{"id": "app-1"}`},
+			wantErr: "missing id or version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := readAppManifest(writeTestPackage(t, tt.files))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.ID != "app-1" || manifest.Version != "1.2.3" || manifest.Name.Short != "Culminate Security" {
+				t.Errorf("unexpected manifest %+v", manifest)
+			}
+		})
+	}
+
+	if _, err := readAppManifest(filepath.Join(t.TempDir(), "missing.zip")); err == nil {
+		t.Error("expected an error for a missing package")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.1", "1.0.0", 1},
+		{"1.0.0", "1.0.1", -1},
+		{"1.2.10", "1.2.9", 1},
+		{"2.0", "10.0", -1},
+		{"1.0", "1.0.0", 0},
+		{"1.0.0.1", "1.0", 1},
+		{"1.0.beta", "1.0.alpha", 1},
+		{"1.0.0", "", 1},
+		{"", "", 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCatalogAppVersions(t *testing.T) {
+	tests := []struct {
+		name          string
+		definitions   []appDefinition
+		wantPublished string
+		wantPending   string
+	}{
+		{
+			name: "newer version pending",
+			definitions: []appDefinition{
+				{Version: "1.0.0", PublishingState: "published"},
+				{Version: "1.2.0", PublishingState: "submitted"},
+				{Version: "2.0.0", PublishingState: "rejected"},
+			},
+			wantPublished: "1.0.0",
+			wantPending:   "1.2.0",
+		},
+		{
+			name: "older submission",
+			definitions: []appDefinition{
+				{Version: "1.1.0", PublishingState: "submitted"},
+				{Version: "1.2.0", PublishingState: "published"},
+			},
+			wantPublished: "1.2.0",
+		},
+		{
+			name:        "never published",
+			definitions: []appDefinition{{Version: "1.0.0", PublishingState: "submitted"}},
+			wantPending: "1.0.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := catalogApp{AppDefinitions: tt.definitions}
+			published, pending := app.versions()
+			if published != tt.wantPublished || pending != tt.wantPending {
+				t.Errorf("got published %q pending %q, want %q and %q", published, pending, tt.wantPublished, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestFindCatalogApp(t *testing.T) {
+	manifest := &appManifest{ID: "App-1", Version: "1.0.0"}
+	manifest.Name.Short = "Culminate Security"
+
+	tests := []struct {
+		name     string
+		filtered string
+		listed   string
+		wantID   string
+	}{
+		{"externalId match", `[{"id": "catalog-1", "externalId": "App-1"}]`, `[]`, "catalog-1"},
+		{"externalId differs in case", `[]`, `[{"id": "other"}, {"id": "catalog-2", "externalId": "app-1"}]`, "catalog-2"},
+		{"display name match", `[]`, `[{"id": "catalog-3", "displayName": "Culminate Security"}]`, "catalog-3"},
+		{"not published", `[]`, `[{"id": "other", "displayName": "Other"}]`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("$expand") != "appDefinitions" {
+					t.Errorf("expected app definitions to be expanded, got %q", r.URL.RawQuery)
+				}
+				switch filter := r.URL.Query().Get("$filter"); filter {
+				case "externalId eq 'App-1'":
+					fmt.Fprintf(w, `{"value": %s}`, tt.filtered)
+				case "distributionMethod eq 'organization'":
+					fmt.Fprintf(w, `{"value": %s}`, tt.listed)
+				default:
+					t.Errorf("unexpected filter %q", filter)
+				}
+			}))
+			defer server.Close()
+
+			app, err := findCatalogApp(newTestGraphClient(server), manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantID == "" {
+				if app != nil {
+					t.Errorf("expected no app, got %+v", app)
+				}
+				return
+			}
+			if app == nil || app.ID != tt.wantID {
+				t.Errorf("expected app %s, got %+v", tt.wantID, app)
+			}
+		})
+	}
+}
+
+func TestEnsureAppInstalledWaitsForPendingVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"value": [{"id": "installation-1", "teamsAppDefinition": {"teamsAppId": "catalog-1", "version": "1.0.0"}}]}`)
+	}))
+	defer server.Close()
+
+	p := &provisioner{
+		client:         newTestGraphClient(server),
+		result:         &setupResult{TeamID: "team-1"},
+		appID:          "catalog-1",
+		appVersion:     "1.0.0",
+		pendingVersion: "1.2.0",
+	}
+	status, detail, err := p.ensureAppInstalled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != setupStepPending || !strings.Contains(detail, "1.2.0") {
+		t.Errorf("expected the install step to wait for approval, got %q (%s)", status, detail)
+	}
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"encoding/base64"
+	"fmt"
 	"log"
 	"os"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/microsoft"
 )
 
+const (
+	oauthStateTTL = 10 * time.Minute
+)
+
 // Global variables
 var (
-	oauthConfig  *oauth2.Config
-	store        *sessions.CookieStore
-	tokenStore   = make(map[string]string)
-	tokenStoreMu sync.Mutex
+	oauthConfig *oauth2.Config
+	store       *sessions.CookieStore
+	tokenStore  TokenStore
 )
 
 // initOAuthConfig initializes the OAuth2 configuration
@@ -39,10 +45,49 @@ func initOAuthConfig() {
 		Endpoint: microsoft.AzureADEndpoint("common"),
 	}
 
-	// Generate a secure key for cookie store
-	secureKey, err := GenerateSecureKey(32)
+	// Load the signing and encryption keys for the cookie store
+	keyPairs, err := loadSessionKeys()
 	if err != nil {
-		log.Fatal("Error generating secure key:", err)
+		log.Fatal("Error loading session keys:", err)
+	}
+	store = sessions.NewCookieStore(keyPairs...)
+}
+
+// loadSessionKeys reads SESSION_KEYS, a comma separated list of "hashKey:blockKey" pairs
+// in base64. The first pair signs and encrypts new cookies, the rest are previous keys that
+// are still accepted so sessions survive a key rotation. The keys are required rather than
+// generated, since every instance must use the same ones.
+func loadSessionKeys() ([][]byte, error) {
+	config := os.Getenv("SESSION_KEYS")
+	if config == "" {
+		return nil, fmt.Errorf("SESSION_KEYS is not set; set it to hashKey:blockKey with a 64 byte and a 32 byte random key in URL-safe base64")
 	}
-	store = sessions.NewCookieStore([]byte(secureKey))
+
+	var keyPairs [][]byte
+	for _, pair := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("session key pair must be hashKey:blockKey")
+		}
+
+		hashKey, err := base64.URLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hash key: %w", err)
+		}
+		if len(hashKey) < 32 {
+			return nil, fmt.Errorf("hash key must be at least 32 bytes")
+		}
+
+		blockKey, err := base64.URLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode block key: %w", err)
+		}
+		if len(blockKey) != 16 && len(blockKey) != 24 && len(blockKey) != 32 {
+			return nil, fmt.Errorf("block key must be 16, 24 or 32 bytes")
+		}
+
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+
+	return keyPairs, nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestLoadSessionKeys(t *testing.T) {
+	key := func(n int) string {
+		return base64.URLEncoding.EncodeToString([]byte(strings.Repeat("k", n)))
+	}
+
+	tests := []struct {
+		name     string
+		config   string
+		wantKeys int
+		wantErr  string
+	}{
+		{"missing", "", 0, "SESSION_KEYS is not set"},
+		{"one pair", key(64) + ":" + key(32), 2, ""},
+		{"rotated pair", key(64) + ":" + key(32) + ", " + key(32) + ":" + key(16), 4, ""},
+		{"no block key", key(64), 0, "hashKey:blockKey"},
+		{"short hash key", key(16) + ":" + key(32), 0, "at least 32 bytes"},
+		{"bad block key size", key(64) + ":" + key(20), 0, "16, 24 or 32 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SESSION_KEYS", tt.config)
+			keys, err := loadSessionKeys()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != tt.wantKeys {
+				t.Errorf("expected %d keys, got %d", tt.wantKeys, len(keys))
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	botOpenIDMetadataURL      = "https://login.botframework.com/v1/.well-known/openidconfiguration"
+	botTokenIssuer            = "https://api.botframework.com"
+	botKeysRefreshPeriod      = 24 * time.Hour
+	botKeysMinRefreshInterval = time.Minute
+	botTokenClockSkew         = 5 * time.Minute
+)
+
+// KeySource resolves the public key used to sign a Bot Framework token
+type KeySource interface {
+	GetKey(kid string) (*rsa.PublicKey, error)
+}
+
+// Global variables
+var (
+	botKeySource KeySource
+)
+
+// initBotAuth sets up the key source used to validate inbound activities
+func initBotAuth() {
+	botKeySource = newOpenIDKeySource(botOpenIDMetadataURL)
+}
+
+// JSON web key as published in the Bot Framework JWKS document
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// openIDKeySource fetches signing keys from the OpenID metadata document and caches them
+type openIDKeySource struct {
+	metadataURL string
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// newOpenIDKeySource creates a key source backed by the given OpenID metadata URL
+func newOpenIDKeySource(metadataURL string) *openIDKeySource {
+	return &openIDKeySource{
+		metadataURL: metadataURL,
+		keys:        make(map[string]*rsa.PublicKey),
+	}
+}
+
+// GetKey returns the cached key for kid, refreshing the JWKS when it is stale or the kid is unknown
+func (s *openIDKeySource) GetKey(kid string) (*rsa.PublicKey, error) {
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	fresh := time.Since(s.fetchedAt) < botKeysRefreshPeriod
+	s.mu.RUnlock()
+
+	if ok && fresh {
+		return key, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Refresh at most once per minute, whether or not the last attempt succeeded, so tokens
+	// with unknown key IDs or an unreachable metadata endpoint cannot trigger a fetch each time
+	if time.Since(s.attemptedAt) > botKeysMinRefreshInterval {
+		s.attemptedAt = time.Now()
+		keys, err := fetchSigningKeys(s.metadataURL)
+		if err != nil {
+			if ok {
+				return key, nil
+			}
+			return nil, err
+		}
+		s.keys = keys
+		s.fetchedAt = time.Now()
+	}
+
+	key, ok = s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+// staticKeySource serves a fixed set of keys, for use with locally generated keys
+type staticKeySource map[string]*rsa.PublicKey
+
+// GetKey returns the key registered for kid
+func (s staticKeySource) GetKey(kid string) (*rsa.PublicKey, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+// fetchSigningKeys reads the jwks_uri from the OpenID metadata and downloads the RSA keys
+func fetchSigningKeys(metadataURL string) (map[string]*rsa.PublicKey, error) {
+	var metadata struct {
+		JwksURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(metadataURL, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to fetch OpenID metadata: %w", err)
+	}
+	if metadata.JwksURI == "" {
+		return nil, fmt.Errorf("OpenID metadata has no jwks_uri")
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(metadata.JwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %s: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey converts the JWK modulus and exponent into an RSA public key
+func (k jsonWebKey) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode exponent: %w", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// getJSON sends a GET request and decodes the JSON response into out
+func getJSON(url string, out interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Claims carried by a Bot Connector token
+type botTokenClaims struct {
+	Issuer     string          `json:"iss"`
+	Audience   json.RawMessage `json:"aud"`
+	ExpiresAt  int64           `json:"exp"`
+	NotBefore  int64           `json:"nbf"`
+	ServiceURL string          `json:"serviceurl"`
+}
+
+// hasAudience reports whether the aud claim (a string or an array) contains audience
+func (c botTokenClaims) hasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return single == audience
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.Audience, &multiple); err == nil {
+		for _, aud := range multiple {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateBotRequest checks the Authorization header of an inbound activity against the Bot Framework
+func validateBotRequest(r *http.Request, serviceURL string) error {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return fmt.Errorf("missing bearer token")
+	}
+	return validateBotToken(strings.TrimPrefix(authHeader, "Bearer "), serviceURL, botKeySource, time.Now())
+}
+
+// validateBotToken verifies the signature and claims of a Bot Connector JWT
+func validateBotToken(token, serviceURL string, keys KeySource, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported signing algorithm: %s", header.Alg)
+	}
+
+	// Verify the signature before trusting any of the claims
+	key, err := keys.GetKey(header.Kid)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	var claims botTokenClaims
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	if claims.Issuer != botTokenIssuer {
+		return fmt.Errorf("invalid issuer: %s", claims.Issuer)
+	}
+	if !claims.hasAudience(os.Getenv("BOT_ID")) {
+		return fmt.Errorf("invalid audience")
+	}
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(botTokenClockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(botTokenClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("token not yet valid")
+	}
+	if !strings.EqualFold(strings.TrimSuffix(claims.ServiceURL, "/"), strings.TrimSuffix(serviceURL, "/")) {
+		return fmt.Errorf("serviceUrl claim does not match activity")
+	}
+
+	return nil
+}
+
+// decodeTokenSegment base64url-decodes a JWT segment and unmarshals it into out
+func decodeTokenSegment(segment string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testBotID      = "test-bot-id"
+	testServiceURL = "https://smba.trafficmanager.net/amer/"
+	testKeyID      = "test-key"
+)
+
+// signTestToken builds an RS256 JWT from the header and claims, signed with key
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signingInput := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestValidateBotToken(t *testing.T) {
+	t.Setenv("BOT_ID", testBotID)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := staticKeySource{testKeyID: &key.PublicKey}
+	now := time.Unix(1700000000, 0)
+
+	validHeader := func() map[string]interface{} {
+		return map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	}
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":        botTokenIssuer,
+			"aud":        testBotID,
+			"exp":        now.Add(time.Hour).Unix(),
+			"nbf":        now.Add(-time.Minute).Unix(),
+			"serviceurl": testServiceURL,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			token: func() string { return signTestToken(t, key, validHeader(), validClaims()) },
+		},
+		{
+			name: "audience array",
+			token: func() string {
+				claims := validClaims()
+				claims["aud"] = []string{"someone-else", testBotID}
+				return signTestToken(t, key, validHeader(), claims)
+			},
+		},
+		{
+			name: "serviceurl without trailing slash",
+			token: func() string {
+				claims := validClaims()
+				claims["serviceurl"] = strings.TrimSuffix(testServiceURL, "/")
+				return signTestToken(t, key, validHeader(), claims)
+			},
+		},
+		{
+			name:    "bad signature",
+			token:   func() string { return signTestToken(t, otherKey, validHeader(), validClaims()) },
+			wantErr: "invalid token signature",
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				parts := strings.Split(signTestToken(t, key, validHeader(), validClaims()), ".")
+				claims := validClaims()
+				claims["aud"] = "attacker"
+				data, _ := json.Marshal(claims)
+				parts[1] = base64.RawURLEncoding.EncodeToString(data)
+				return strings.Join(parts, ".")
+			},
+			wantErr: "invalid token signature",
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := validClaims()
+				claims["iss"] = "https://evil.example.com"
+				return signTestToken(t, key, validHeader(), claims)
+			},
+			wantErr: "invalid issuer",
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := validClaims()
+				claims["aud"] = "another-bot"
+				return signTestToken(t, key, validHeader(), claims)
+			},
+			wantErr: "invalid audience",
+		},
+		{
+			name: "expired within clock skew",
+			token: func() string {
+				claims := validClaims()
+				claims["exp"] = now.Add(-botTokenClockSkew + time.Second).Unix()
+				return signTestToken(t, key, validHeader(), claims)
+			},
+		},
+		{
+			name: "expired beyond clock skew",
+			token: func() string {
+				claims := validClaims()
+				claims["exp"] = now.Add(-botTokenClockSkew - time.Second).Unix()
+				return signTestToken(t, key, validHeader(), claims)
+			},
+			wantErr: "token expired",
+		},
+		{
+			name: "missing expiry",
+			token: func() string {
+				claims := validClaims()
+				delete(claims, "exp")
+				return signTestToken(t, key, validHeader(), claims)
+			},
+			wantErr: "token expired",
+		},
+		{
+			name: "not yet valid within clock skew",
+			token: func() string {
+				claims := validClaims()
+				claims["nbf"] = now.Add(botTokenClockSkew - time.Second).Unix()
+				return signTestToken(t, key, validHeader(), claims)
+			},
+		},
+		{
+			name: "not yet valid beyond clock skew",
+			token: func() string {
+				claims := validClaims()
+				claims["nbf"] = now.Add(botTokenClockSkew + time.Second).Unix()
+				return signTestToken(t, key, validHeader(), claims)
+			},
+			wantErr: "token not yet valid",
+		},
+		{
+			name: "unknown kid",
+			token: func() string {
+				header := validHeader()
+				header["kid"] = "rotated-key"
+				return signTestToken(t, key, header, validClaims())
+			},
+			wantErr: "unknown signing key",
+		},
+		{
+			name: "unsupported algorithm",
+			token: func() string {
+				header := validHeader()
+				header["alg"] = "none"
+				return signTestToken(t, key, header, validClaims())
+			},
+			wantErr: "unsupported signing algorithm",
+		},
+		{
+			name: "serviceurl mismatch",
+			token: func() string {
+				claims := validClaims()
+				claims["serviceurl"] = "https://attacker.example.com/"
+				return signTestToken(t, key, validHeader(), claims)
+			},
+			wantErr: "serviceUrl claim does not match",
+		},
+		{
+			name:    "malformed",
+			token:   func() string { return "not-a-jwt" },
+			wantErr: "malformed token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBotToken(tt.token(), testServiceURL, keys, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected token to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestOpenIDKeySourceLimitsRefreshes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			fetches++
+			fmt.Fprintf(w, `{"jwks_uri": "%s/keys"}`, server.URL)
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kid": testKeyID,
+					"kty": "RSA",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+				}},
+			})
+		}
+	}))
+	defer server.Close()
+
+	source := newOpenIDKeySource(server.URL + "/metadata")
+
+	got, err := source.GetKey(testKeyID)
+	if err != nil {
+		t.Fatalf("expected key, got %v", err)
+	}
+	if got.N.Cmp(key.PublicKey.N) != 0 || got.E != key.PublicKey.E {
+		t.Fatal("fetched key does not match the published key")
+	}
+
+	// Unknown key IDs must not trigger another fetch within the refresh interval
+	for i := 0; i < 5; i++ {
+		if _, err := source.GetKey("unknown"); err == nil {
+			t.Fatal("expected unknown kid to fail")
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected 1 metadata fetch, got %d", fetches)
+	}
+}
+
+func TestOpenIDKeySourceLimitsFailedRefreshes(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	source := newOpenIDKeySource(server.URL)
+	for i := 0; i < 5; i++ {
+		if _, err := source.GetKey(testKeyID); err == nil {
+			t.Fatal("expected lookup to fail")
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected 1 metadata fetch, got %d", fetches)
+	}
+}
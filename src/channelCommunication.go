@@ -2,24 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // Sends the message as the bot to the reports channel
 func sendBotMessage(channelID, message string, card ...map[string]interface{}) error {
-	botToken, err := getValidBotToken()
-	if err != nil {
-		return fmt.Errorf("failed to get valid bot token: %w", err)
-	}
-
-	url := fmt.Sprintf("https://smba.trafficmanager.net/amer/v3/conversations/%s/activities", channelID)
-
 	var payload map[string]interface{}
 	if len(card) > 0 {
 		payload = card[0]
@@ -30,32 +26,123 @@ func sendBotMessage(channelID, message string, card ...map[string]interface{}) e
 		}
 	}
 
-	jsonData, err := json.Marshal(payload)
+	_, err := postActivity(channelID, payload)
+	return err
+}
+
+// Posts an activity to a conversation and returns the ID the Bot Connector assigned to it
+func postActivity(conversationID string, payload map[string]interface{}) (string, error) {
+	body, err := botConnectorRequest("POST", conversationActivitiesURL(conversationID), payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON payload: %w", err)
+		return "", fmt.Errorf("failed to send message: %w", err)
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", fmt.Errorf("failed to decode response: %w", err)
+		}
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	return result.ID, nil
+}
+
+// Replaces a previously posted activity, for example to show an updated card
+func updateActivity(conversationID, activityID string, payload map[string]interface{}) error {
+	activity := map[string]interface{}{"id": activityID}
+	for key, value := range payload {
+		activity[key] = value
+	}
+
+	_, err := botConnectorRequest("PUT", conversationActivitiesURL(conversationID)+"/"+activityID, activity)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to update activity: %w", err)
 	}
+	return nil
+}
+
+// Deletes a previously posted activity
+func deleteActivity(conversationID, activityID string) error {
+	_, err := botConnectorRequest("DELETE", conversationActivitiesURL(conversationID)+"/"+activityID, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete activity: %w", err)
+	}
+	return nil
+}
+
+// Sends an authenticated request to the Bot Connector and returns the response body.
+// Throttling and transient failures are retried with backoff; the returned error is a
+// *SendError that tells whether the failure was permanent or retries ran out.
+func botConnectorRequest(method, url string, payload interface{}) ([]byte, error) {
+	var jsonData []byte
+	if payload != nil {
+		var err error
+		jsonData, err = json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON payload: %w", err)
+		}
+	}
+
+	return botRetryPolicy.do(func(ctx context.Context) ([]byte, error) {
+		return botConnectorAttempt(ctx, method, url, jsonData)
+	})
+}
+
+// Makes a single Bot Connector request
+func botConnectorAttempt(ctx context.Context, method, url string, jsonData []byte) ([]byte, error) {
+	botToken, err := getValidBotToken()
+	if err != nil {
+		return nil, &SendError{Err: fmt.Errorf("failed to get valid bot token: %w", err)}
+	}
+
+	var reqBody io.Reader
+	if jsonData != nil {
+		reqBody = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return nil, &SendError{Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+
+	// Every attempt, including retries, counts against the conversation and global limits
+	sendLimiter.Wait(limiterKey(url))
 
 	req.Header.Set("Authorization", "Bearer "+botToken)
-	req.Header.Set("Content-Type", "application/json")
+	if jsonData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// Track whether the request reached the server, since a POST that did may have been applied
+	var written atomic.Bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { written.Store(true) },
+	}))
+
+	resp, err := botHTTPClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		// Network errors and timeouts may be transient, but only retry when that cannot duplicate the request
+		return nil, &SendError{
+			Retryable: !written.Load() || isIdempotentMethod(method),
+			Err:       fmt.Errorf("failed to send request: %w", err),
+		}
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to send message (status %d): %s", resp.StatusCode, string(body))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, &SendError{
+			StatusCode: resp.StatusCode,
+			Retryable:  isRetryableResponse(method, resp.StatusCode, retryAfter),
+			RetryAfter: retryAfter,
+			Err:        fmt.Errorf("%s", string(body)),
+		}
 	}
 
-	return nil
+	return body, nil
 }
 
 // JSON format for the investigation card
@@ -90,6 +177,7 @@ func createInvestigationCard(time, title, severity, description string) map[stri
 						},
 						{
 							"type":   "TextBlock",
+							"id":     "severity",
 							"text":   fmt.Sprintf("Severity: %s", severity),
 							"weight": "bolder",
 							"wrap":   true,
@@ -112,6 +200,98 @@ func createInvestigationCard(time, title, severity, description string) map[stri
 	}
 }
 
+// JSON format for an investigation report received through the API
+func createReportCard(report InvestigationReport) map[string]interface{} {
+	card := createInvestigationCard(report.Time.Format(time.RFC1123), report.Title, string(report.Severity), report.Description)
+	content := cardContent(card)
+	body := content["body"].([]map[string]interface{})
+
+	// Show the status right below the severity line
+	if report.Status != "" {
+		body = insertAfterBlock(body, "severity", map[string]interface{}{
+			"type":   "TextBlock",
+			"id":     "status",
+			"text":   fmt.Sprintf("Status: %s", report.Status),
+			"weight": "bolder",
+			"color":  reportStatusColor(report.Status),
+			"wrap":   true,
+		})
+	}
+
+	if report.CaseID != "" {
+		body = append(body, map[string]interface{}{
+			"type":      "TextBlock",
+			"text":      fmt.Sprintf("Case: %s", report.CaseID),
+			"isSubtle":  true,
+			"separator": true,
+			"wrap":      true,
+		})
+	}
+
+	if len(report.Indicators) > 0 {
+		facts := []map[string]interface{}{}
+		for _, indicator := range report.Indicators {
+			facts = append(facts, map[string]interface{}{
+				"title": indicator.Type,
+				"value": indicator.Value,
+			})
+		}
+		body = append(body,
+			map[string]interface{}{
+				"type":      "TextBlock",
+				"text":      "Indicators",
+				"weight":    "bolder",
+				"separator": true,
+			},
+			map[string]interface{}{
+				"type":  "FactSet",
+				"facts": facts,
+			},
+		)
+	}
+	content["body"] = body
+
+	if len(report.Links) > 0 {
+		actions := []map[string]interface{}{}
+		for _, link := range report.Links {
+			actions = append(actions, map[string]interface{}{
+				"type":  "Action.OpenUrl",
+				"title": link.Title,
+				"url":   link.URL,
+			})
+		}
+		content["actions"] = actions
+	}
+
+	return card
+}
+
+// insertAfterBlock inserts block after the card element with the given id, or appends it when no element has that id
+func insertAfterBlock(body []map[string]interface{}, id string, block map[string]interface{}) []map[string]interface{} {
+	for i, element := range body {
+		if element["id"] == id {
+			result := make([]map[string]interface{}, 0, len(body)+1)
+			result = append(result, body[:i+1]...)
+			result = append(result, block)
+			return append(result, body[i+1:]...)
+		}
+	}
+	return append(body, block)
+}
+
+// Returns the Adaptive Card inside a card message
+func cardContent(card map[string]interface{}) map[string]interface{} {
+	return card["attachments"].([]map[string]interface{})[0]["content"].(map[string]interface{})
+}
+
+// Text color used to show a report status on a card
+func reportStatusColor(status ReportStatus) string {
+	if status == ReportStatusResolved {
+		return "good"
+	}
+	return "attention"
+}
+
 // Gets the bot token from the Bot Framework API
 func getBotToken() (string, time.Time, error) {
 	url := "https://login.microsoftonline.com/botframework.com/oauth2/v2.0/token"
@@ -120,19 +300,28 @@ func getBotToken() (string, time.Time, error) {
 	req, _ := http.NewRequest("POST", url, payload)
 	req.Header.Add("content-type", "application/x-www-form-urlencoded")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := botHTTPClient.Do(req)
 	if err != nil {
 		return "", time.Time{}, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return "", time.Time{}, fmt.Errorf("token request failed (status %d): %s", res.StatusCode, string(body))
+	}
+
 	var result map[string]interface{}
 	json.NewDecoder(res.Body).Decode(&result)
 
-	expiresIn := result["expires_in"].(float64)
+	expiresIn, _ := result["expires_in"].(float64)
+	accessToken, ok := result["access_token"].(string)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("token response has no access_token")
+	}
 	expiresAt := time.Now().Add(time.Duration(expiresIn) * time.Second)
 
-	return result["access_token"].(string), expiresAt, nil
+	return accessToken, expiresAt, nil
 }
 
 // Checks if the current bot token is valid and returns it, or fetches a new one if necessary
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	contactsBucket         = "contacts"
+	conversationRefsBucket = "conversation_refs"
+)
+
+// First contact between the bot and a user or team
+type Contact struct {
+	Key            string    `json:"key"`
+	Name           string    `json:"name"`
+	ConversationID string    `json:"conversationId"`
+	TenantID       string    `json:"tenantId"`
+	WelcomedAt     time.Time `json:"welcomedAt"`
+}
+
+// Personal conversation the bot started with a user
+type ConversationReference struct {
+	TenantID       string    `json:"tenantId"`
+	AADObjectID    string    `json:"aadObjectId"`
+	ConversationID string    `json:"conversationId"`
+	ServiceURL     string    `json:"serviceUrl"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// ContactStore remembers who has already been welcomed and how to reach users proactively
+type ContactStore interface {
+	MarkWelcomed(contact *Contact) (bool, error)
+	UnmarkWelcomed(key string) error
+	Get(key string) (*Contact, error)
+	SaveConversationRef(ref *ConversationReference) error
+	GetConversationRef(tenantID, aadObjectID string) (*ConversationReference, error)
+}
+
+// Global variables
+var (
+	contactStore ContactStore
+)
+
+// boltContactStore keeps contacts in BoltDB keyed by user or team
+type boltContactStore struct {
+	db *bolt.DB
+}
+
+// initContactStore opens the contact store
+func initContactStore() {
+	store, err := newBoltContactStore(db)
+	if err != nil {
+		log.Fatal("Error opening contact store:", err)
+	}
+	contactStore = store
+}
+
+// newBoltContactStore creates the contacts bucket if needed
+func newBoltContactStore(db *bolt.DB) (*boltContactStore, error) {
+	err := createBuckets(db, contactsBucket, conversationRefsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &boltContactStore{db: db}, nil
+}
+
+// MarkWelcomed records the contact unless it was welcomed before. It reports whether this is the first contact.
+func (s *boltContactStore) MarkWelcomed(contact *Contact) (bool, error) {
+	first := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		contacts := tx.Bucket([]byte(contactsBucket))
+		if contacts.Get([]byte(contact.Key)) != nil {
+			return nil
+		}
+
+		data, err := json.Marshal(contact)
+		if err != nil {
+			return fmt.Errorf("failed to marshal contact: %w", err)
+		}
+		first = true
+		return contacts.Put([]byte(contact.Key), data)
+	})
+	return first, err
+}
+
+// UnmarkWelcomed forgets a contact so it is welcomed again next time, for when the welcome could not be sent
+func (s *boltContactStore) UnmarkWelcomed(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(contactsBucket)).Delete([]byte(key))
+	})
+}
+
+// Get returns the contact with the given key, or nil when it has never been welcomed
+func (s *boltContactStore) Get(key string) (*Contact, error) {
+	var contact *Contact
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(contactsBucket)).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		contact = &Contact{}
+		return json.Unmarshal(data, contact)
+	})
+	return contact, err
+}
+
+// SaveConversationRef caches the personal conversation with a user
+func (s *boltContactStore) SaveConversationRef(ref *ConversationReference) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation reference: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(conversationRefsBucket)).Put([]byte(ref.TenantID+"/"+ref.AADObjectID), data)
+	})
+}
+
+// GetConversationRef returns the cached personal conversation with a user, or nil when there is none
+func (s *boltContactStore) GetConversationRef(tenantID, aadObjectID string) (*ConversationReference, error) {
+	var ref *ConversationReference
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(conversationRefsBucket)).Get([]byte(tenantID + "/" + aadObjectID))
+		if data == nil {
+			return nil
+		}
+		ref = &ConversationReference{}
+		return json.Unmarshal(data, ref)
+	})
+	return ref, err
+}
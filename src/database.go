@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultDatabaseFile = "culminate.db"
+)
+
+// Global variables
+var (
+	db *bolt.DB
+)
+
+// initDatabase opens the embedded database shared by the stores
+func initDatabase() {
+	path := os.Getenv("DATABASE_FILE")
+	if path == "" {
+		path = defaultDatabaseFile
+	}
+
+	var err error
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		log.Fatal("Error opening database:", err)
+	}
+}
+
+// createBuckets makes sure every named bucket exists
+func createBuckets(db *bolt.DB, names ...string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// itob encodes a number as a big-endian key so keys sort numerically
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// btoi decodes a big-endian key
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
@@ -6,7 +6,11 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/gorilla/sessions v1.3.0
 	github.com/joho/godotenv v1.5.1
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/oauth2 v0.21.0
 )
 
-require github.com/gorilla/securecookie v1.1.2 // indirect
+require (
+	github.com/gorilla/securecookie v1.1.2 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Global variables
+var (
+	// Graph calls share one client. The timeout is longer than for the Bot Connector since app
+	// package uploads and team creation can be slow.
+	graphHTTPClient = &http.Client{Timeout: 60 * time.Second}
+
+	graphRetryPolicy = retryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   1 * time.Second,
+		MaxDelay:    60 * time.Second,
+	}
+)
+
+// GraphError is an error response decoded from Microsoft Graph
+type GraphError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+// Error includes the status code, Graph error code and request ID when known
+func (e *GraphError) Error() string {
+	msg := fmt.Sprintf("graph request failed with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RequestID != "" {
+		msg += " (request-id " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// isGraphStatus reports whether err is a Graph error with the given status code
+func isGraphStatus(err error, statusCode int) bool {
+	var graphErr *GraphError
+	return errors.As(err, &graphErr) && graphErr.StatusCode == statusCode
+}
+
+// GraphClient sends authenticated requests to Microsoft Graph
+type GraphClient struct {
+	baseURL string
+	tokens  oauth2.TokenSource
+	http    *http.Client
+	retry   retryPolicy
+}
+
+// graphResponse is a successful Graph response
+type graphResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// newGraphClient creates a client that authenticates with tokens. The base URL
+// defaults to graphAPIBaseURL and can be overridden with GRAPH_BASE_URL.
+func newGraphClient(tokens oauth2.TokenSource) *GraphClient {
+	baseURL := os.Getenv("GRAPH_BASE_URL")
+	if baseURL == "" {
+		baseURL = graphAPIBaseURL
+	}
+	return &GraphClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		tokens:  tokens,
+		http:    graphHTTPClient,
+		retry:   graphRetryPolicy,
+	}
+}
+
+// newTokenGraphClient creates a client for a single access token
+func newTokenGraphClient(accessToken string) *GraphClient {
+	return newGraphClient(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+}
+
+// newTenantGraphClient creates a client that uses the tenant's stored token, refreshing it as needed
+func newTenantGraphClient(tenantID string) (*GraphClient, error) {
+	integration, err := FindIntegration(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if integration == nil || integration.Integration.Teams.TokenKey == "" {
+		return nil, fmt.Errorf("tenant %s has no stored token", tenantID)
+	}
+
+	tokens, err := getTokenSource(context.Background(), integration.Integration.Teams.TokenKey)
+	if err != nil {
+		return nil, err
+	}
+	return newGraphClient(tokens), nil
+}
+
+// Get sends a GET request and decodes the response into out
+func (c *GraphClient) Get(path string, out interface{}) error {
+	resp, err := c.Do("GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	return decodeGraphBody(resp, out)
+}
+
+// GetAll follows @odata.nextLink and decodes the combined value arrays of every page into out,
+// which must point to a slice
+func (c *GraphClient) GetAll(path string, out interface{}) error {
+	var items []json.RawMessage
+	for path != "" {
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"@odata.nextLink"`
+		}
+		if err := c.Get(path, &page); err != nil {
+			return err
+		}
+		items = append(items, page.Value...)
+		path = page.NextLink
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("failed to marshal results: %w", err)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Post sends payload as JSON and decodes the response into out when out is not nil
+func (c *GraphClient) Post(path string, payload, out interface{}) (*graphResponse, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON payload: %w", err)
+	}
+	resp, err := c.Do("POST", path, "application/json", jsonData)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		if err := decodeGraphBody(resp, out); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// Do sends a request, retrying throttled and transient failures and honouring Retry-After.
+// A POST is only retried when it never reached Graph or Graph says it was not processed, and
+// a Retry-After beyond the policy's MaxDelay is returned as an error rather than waited out.
+// path may be relative to the base URL or an absolute URL such as a nextLink.
+func (c *GraphClient) Do(method, path, contentType string, body []byte) (*graphResponse, error) {
+	url := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		url = c.baseURL + path
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, retryAfter, err := c.send(method, url, contentType, body)
+		if err == nil {
+			return resp, nil
+		}
+
+		// Network errors follow the same rule as Bot Connector sends: retry when the request never
+		// reached Graph or sending it twice is harmless
+		var graphErr *GraphError
+		retryable := isRetryable(err)
+		if errors.As(err, &graphErr) {
+			retryable = isRetryableResponse(method, graphErr.StatusCode, retryAfter)
+		}
+		if !retryable || attempt >= c.retry.MaxAttempts || retryAfter > c.retry.MaxDelay {
+			return nil, err
+		}
+
+		time.Sleep(c.retry.delay(attempt, retryAfter))
+	}
+}
+
+// send makes a single request, returning the Retry-After delay with any error response
+func (c *GraphClient) send(method, url, contentType string, body []byte) (*graphResponse, time.Duration, error) {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get access token: %w", err)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	var written atomic.Bool
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { written.Store(true) },
+	}))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, &SendError{
+			Retryable: !written.Load() || isIdempotentMethod(method),
+			Err:       fmt.Errorf("failed to send request: %w", err),
+		}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), decodeGraphError(resp, respBody)
+	}
+
+	return &graphResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: respBody}, 0, nil
+}
+
+// decodeGraphError builds a GraphError from an error response body
+func decodeGraphError(resp *http.Response, body []byte) *GraphError {
+	graphErr := &GraphError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("request-id"),
+	}
+
+	var result struct {
+		Error struct {
+			Code       string `json:"code"`
+			Message    string `json:"message"`
+			InnerError struct {
+				RequestID string `json:"request-id"`
+			} `json:"innerError"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		graphErr.Message = strings.TrimSpace(string(body))
+		return graphErr
+	}
+
+	graphErr.Code = result.Error.Code
+	graphErr.Message = result.Error.Message
+	if graphErr.RequestID == "" {
+		graphErr.RequestID = result.Error.InnerError.RequestID
+	}
+	return graphErr
+}
+
+// decodeGraphBody unmarshals a response body into out
+func decodeGraphBody(resp *graphResponse, out interface{}) error {
+	if len(resp.Body) == 0 {
+		return fmt.Errorf("empty response body")
+	}
+	err := json.Unmarshal(resp.Body, out)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newTestGraphClient creates a client for server with a short retry policy
+func newTestGraphClient(server *httptest.Server) *GraphClient {
+	client := newGraphClient(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"}))
+	client.baseURL = server.URL
+	client.retry = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	return client
+}
+
+func TestGraphClientGetAllFollowsNextLink(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"value": [{"id": "c"}]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"value": [{"id": "a"}, {"id": "b"}], "@odata.nextLink": "%s/teams?page=2"}`, server.URL)
+	}))
+	defer server.Close()
+
+	var teams []struct {
+		ID string `json:"id"`
+	}
+	if err := newTestGraphClient(server).GetAll("/teams", &teams); err != nil {
+		t.Fatal(err)
+	}
+	if len(teams) != 3 || teams[0].ID != "a" || teams[2].ID != "c" {
+		t.Errorf("expected items from both pages, got %+v", teams)
+	}
+}
+
+func TestGraphClientRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		status     int
+		retryAfter string
+		wantCalls  int32
+	}{
+		{"GET transient failure", http.MethodGet, http.StatusInternalServerError, "", 3},
+		{"GET not found", http.MethodGet, http.StatusNotFound, "", 1},
+		{"POST transient failure", http.MethodPost, http.StatusInternalServerError, "", 1},
+		{"POST throttled", http.MethodPost, http.StatusTooManyRequests, "", 3},
+		{"Retry-After beyond max delay", http.MethodGet, http.StatusTooManyRequests, "3600", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.Header().Set("request-id", "req-1")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"error": {"code": "failed", "message": "try later"}}`)
+			}))
+			defer server.Close()
+
+			_, err := newTestGraphClient(server).Do(tt.method, "/teams", "", nil)
+			if !isGraphStatus(err, tt.status) {
+				t.Fatalf("expected a Graph error with status %d, got %v", tt.status, err)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls.Load())
+			}
+		})
+	}
+}
+
+func TestGraphClientRetriesNetworkErrors(t *testing.T) {
+	tests := []struct {
+		method    string
+		wantCalls int32
+	}{
+		{http.MethodGet, 2},
+		{http.MethodPost, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Drop the connection after the request arrived on the first call
+				if calls.Add(1) == 1 {
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err == nil {
+						conn.Close()
+					}
+					return
+				}
+				fmt.Fprint(w, `{"id": "1"}`)
+			}))
+			defer server.Close()
+
+			_, err := newTestGraphClient(server).Do(tt.method, "/teams", "application/json", []byte("{}"))
+			if tt.method == http.MethodPost && err == nil {
+				t.Error("expected the POST that reached Graph not to be repeated")
+			}
+			if tt.method == http.MethodGet && err != nil {
+				t.Errorf("expected the GET to succeed on retry, got %v", err)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls.Load())
+			}
+		})
+	}
+}
+
+func TestDecodeGraphError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}}
+	graphErr := decodeGraphError(resp, []byte(`{"error": {"code": "Forbidden", "message": "denied", "innerError": {"request-id": "abc"}}}`))
+	if graphErr.Code != "Forbidden" || graphErr.Message != "denied" || graphErr.RequestID != "abc" {
+		t.Errorf("unexpected error %+v", graphErr)
+	}
+
+	graphErr = decodeGraphError(resp, []byte("gateway timeout\n"))
+	if graphErr.Message != "gateway timeout" {
+		t.Errorf("expected the raw body as the message, got %q", graphErr.Message)
+	}
+}
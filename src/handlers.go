@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
 )
 
 // Login the user by starting a new OAuth session
@@ -43,33 +44,66 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Verify the state and recover the PKCE verifier for this login
+	verifier, err := consumeOAuthState(session, r, w)
+	if err != nil {
+		log.Printf("Rejected OAuth callback: %v", err)
+		renderAuthError(w, http.StatusBadRequest, "Your login could not be verified: "+err.Error()+". Please sign in again.")
+		return
+	}
+
 	// Exchange token
-	token, err := exchangeToken(r)
+	token, err := exchangeToken(r, verifier)
 	if err != nil {
 		log.Printf("Failed to exchange token: %v", err)
 		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Identify the tenant and user that signed in
+	tenantID, userID, err := tokenIdentity(token)
+	if err != nil {
+		log.Printf("Failed to identify tenant: %v", err)
+		http.Error(w, "Failed to identify tenant: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Store the token in the session
-	err = storeTokenInSession(session, r, w, token)
+	key := tokenKey(tenantID, userID)
+	err = storeTokenInSession(session, r, w, key, token)
 	if err != nil {
+		log.Printf("Failed to store token: %v", err)
 		http.Error(w, "Failed to save session", http.StatusInternalServerError)
 		return
 	}
 
-	// Setup the environment (create Teams and Channel and upload app)
-	result, err := setupEnvironment(token.AccessToken)
+	// Use the stored token so it is refreshed if setup outlives the access token
+	accessToken, err := getAccessToken(key)
+	if err != nil {
+		log.Printf("Failed to get access token: %v", err)
+		http.Error(w, "Failed to get access token", http.StatusInternalServerError)
+		return
+	}
+
+	// Remember the tenant's token before setup so its progress can be saved
+	err = SaveTenantIntegration(Teams{TenantID: tenantID, TokenKey: key})
+	if err != nil {
+		log.Printf("Failed to save integration for tenant %s: %v", tenantID, err)
+	}
+
+	// Reconcile the environment (team, Reports channel, app and welcome message)
+	result, err := setupEnvironment(tenantID, accessToken)
 	if err != nil {
 		log.Printf("Failed to setup environment: %v", err)
-		http.Error(w, "Failed to setup environment: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to setup environment: "+err.Error()+"\n\n"+result.Message+"\n\nSign in again to resume setup.", http.StatusInternalServerError)
 		return
 	}
 
 	// Display the result to the user
-	fmt.Fprint(w, result)
+	fmt.Fprint(w, result.Message)
 }
 
+// Handle activities sent to the bot by the Bot Connector
 func messagesHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -86,42 +120,116 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if activity.Type == "message" && activity.Value.UserQuestion != "" {
+	// Reject activities that were not sent by the Bot Connector
+	err = validateBotRequest(r, activity.ServiceURL)
+	if err != nil {
+		log.Printf("Rejected unauthenticated activity: %v", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Remember where to send replies for this conversation and tenant
+	rememberServiceURL(activity)
+	err = updateTenantServiceURL(activity)
+	if err != nil {
+		log.Printf("Failed to update serviceUrl for tenant %s: %v", activity.TenantID(), err)
+	}
+
+	// The Bot Connector gives up on a reply after about 15 seconds, which sends and their
+	// retries can exceed. Only invokes carry a result in the response, so everything else is
+	// acknowledged first and handled afterwards.
+	if activity.Type != activityTypeInvoke {
+		w.WriteHeader(http.StatusOK)
+		go dispatchActivity(activity)
+		return
+	}
+
+	response, handled := dispatchActivity(activity)
+	if !handled {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	if response != nil {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// dispatchActivity runs the activity's handler, logging activities that have none
+func dispatchActivity(activity Activity) (*InvokeResponse, bool) {
+	response, handled := activityRouter.Dispatch(activity)
+	if !handled {
+		log.Printf("No handler for %s activity %s", activity.Type, activity.Name)
+	}
+	return response, handled
+}
+
+// Route messages to card submissions or plain user message handling
+func handleMessageActivity(activity Activity) *InvokeResponse {
+	if activity.Value.CardAction == "triage" {
+		// This is a triage button on an investigation card
+		handleTriageAction(activity)
+	} else if activity.Value.CardAction == "analystReply" {
+		// This is an analyst answering a forwarded question
+		handleAnalystReply(activity)
+	} else if activity.Value.UserQuestion != "" {
 		// This is a card submission
-		handleCardResponse(w, activity)
-	} else if activity.Type == "message" {
+		handleCardResponse(activity)
+	} else {
 		// This is a new user message
 		handleNewUserMessage(activity)
 	}
-
-	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
+// Treat plain text in a personal chat as a question on the user's open case
 func handleNewUserMessage(activity Activity) {
-	conversationID := activity.Conversation.ID
-	userName := activity.From.Name
+	if activity.Conversation.ConversationType != "" && activity.Conversation.ConversationType != "personal" {
+		log.Printf("Ignoring message in %s conversation %s", activity.Conversation.ConversationType, activity.Conversation.ID)
+		return
+	}
 
-	// Record the user's message
-	err := RecordUserMessage(activity)
-	if err != nil {
-		log.Printf("Failed to record user message: %v", err)
+	// Users who installed the bot before first-contact tracking still get one welcome
+	welcomed := welcomeUser(activity)
+
+	question := stripBotMentions(activity)
+	if question == "" {
+		if !welcomed {
+			offerWelcomeCard(activity)
+		}
+		return
 	}
 
-	// Send personalized welcome message
-	welcomeMessage := fmt.Sprintf("Hello **%s**, I hope you are having a great day!\n\n I am Culminate Security's virtual assistant and I am here to respond to any questions you have.", userName)
-	err = sendBotMessage(conversationID, welcomeMessage)
+	log.Printf("Received question from user %s: %s", activity.From.Name, question)
+
+	openCase, err := messageStore.OpenCase(activity.Conversation.ID)
 	if err != nil {
-		log.Printf("Failed to send welcome message to user %s: %v", userName, err)
+		log.Printf("Failed to look up open case: %v", err)
 	}
 
-	// Send welcome card
-	err = sendWelcomeCardToConversation(conversationID, userName)
+	// Record the question on the open case, or open a new one
+	row, err := RecordUserMessage(activity, question, openCase == 0)
 	if err != nil {
-		log.Printf("Failed to send welcome card to user %s: %v", userName, err)
+		log.Printf("Failed to record user question: %v", err)
+		reportQuestionNotRecorded(activity)
+		return
+	}
+
+	var response string
+	if openCase == 0 {
+		response = fmt.Sprintf("Thank you for your question, **%s**\n\n**Your Question:** '%s'\n\nWe opened case #%d and our team will get back to you shortly!", activity.From.Name, question, row.CaseNumber)
+	} else {
+		response = fmt.Sprintf("Thanks **%s**, I added your message to case #%d. Our team will get back to you shortly!", activity.From.Name, row.CaseNumber)
 	}
+	acknowledgeQuestion(activity, response)
+	forwardQuestionToAnalysts(activity, row, question)
 }
 
-func handleCardResponse(w http.ResponseWriter, activity Activity) {
+// Handle a question typed into the welcome card
+func handleCardResponse(activity Activity) {
 	if activity.Value.UserQuestion == "" {
 		log.Println("Received empty question, ignoring")
 		return
@@ -129,29 +237,55 @@ func handleCardResponse(w http.ResponseWriter, activity Activity) {
 
 	log.Printf("Received question from user %s: %s", activity.From.Name, activity.Value.UserQuestion)
 
-	// Record the user's question
-	err := RecordUserMessage(activity)
+	// Record the user's question as a new case
+	row, err := RecordUserMessage(activity, activity.Value.UserQuestion, true)
 	if err != nil {
 		log.Printf("Failed to record user question: %v", err)
+		reportQuestionNotRecorded(activity)
+		return
 	}
 
 	response := fmt.Sprintf("Thank you for your question, **%s**\n\n**Your Question:** '%s'\n\nOur team will get back to you shortly!", activity.From.Name, activity.Value.UserQuestion)
+	acknowledgeQuestion(activity, response)
+	forwardQuestionToAnalysts(activity, row, activity.Value.UserQuestion)
+}
+
+// reportQuestionNotRecorded tells the user their question was lost so they can ask again
+func reportQuestionNotRecorded(activity Activity) {
+	err := sendBotMessage(activity.Conversation.ID, "Sorry, we could not record your question. Please try sending it again in a moment.")
+	if err != nil {
+		log.Printf("Failed to send bot message: %v", err)
+	}
+}
 
-	// Send and record the bot's response
-	err = sendBotMessage(activity.Conversation.ID, response)
+// Send and record the bot's response to a user question
+func acknowledgeQuestion(activity Activity, response string) {
+	err := sendBotMessage(activity.Conversation.ID, response)
 	if err != nil {
 		log.Printf("Failed to send bot message: %v", err)
-		http.Error(w, "Failed to send response", http.StatusInternalServerError)
 		return
 	}
 
 	// Record the bot's response
 	err = SendTeamsMessage(TeamsMessageRequest{
-		TeamsUserId: activity.From.ID,
-		Message:     response,
-		Context:     "Bot response to user question",
+		TeamsUserId:    activity.From.ID,
+		TeamsUserEmail: getUserProfile(activity).Email,
+		Message:        response,
+		Context:        "Bot response to user question",
+		ConversationID: activity.Conversation.ID,
 	})
 	if err != nil {
 		log.Printf("Failed to record bot message: %v", err)
 	}
 }
+
+// Returns the message text without the bot's @mentions
+func stripBotMentions(activity Activity) string {
+	text := activity.Text
+	for _, entity := range activity.Entities {
+		if entity.Type == "mention" && entity.Mentioned != nil && entity.Mentioned.ID == activity.Recipient.ID {
+			text = strings.ReplaceAll(text, entity.Text, "")
+		}
+	}
+	return strings.TrimSpace(text)
+}
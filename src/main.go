@@ -17,8 +17,6 @@ const (
 var (
 	currentBotToken *BotToken
 	botTokenMutex   sync.RWMutex
-	channelID       string
-	channelIDMutex  sync.RWMutex
 )
 
 func main() {
@@ -31,6 +29,20 @@ func main() {
 	// Initialize OAuth configuration
 	initOAuthConfig()
 
+	// Open the encrypted OAuth token store
+	initTokenStore()
+
+	// Open the embedded database and its stores
+	initDatabase()
+	initMessageStore()
+	initReportStore()
+	initContactStore()
+	initSendLimiter()
+	initOutboundQueue()
+
+	// Initialize Bot Framework token validation
+	initBotAuth()
+
 	// Create a new router
 	r := mux.NewRouter()
 
@@ -51,17 +63,3 @@ func main() {
 	log.Println("Main server started at http://localhost:3958/login")
 	log.Fatal(http.ListenAndServe(":3958", nil))
 }
-
-// updateChannelID updates the global channelID
-func updateChannelID(id string) {
-	channelIDMutex.Lock()
-	defer channelIDMutex.Unlock()
-	channelID = id
-}
-
-// getChannelID retrieves the global channelID
-func getChannelID() string {
-	channelIDMutex.RLock()
-	defer channelIDMutex.RUnlock()
-	return channelID
-}
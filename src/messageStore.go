@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket names used by the message store
+const (
+	messagesBucket         = "messages"
+	messagesByUserBucket   = "messages_by_user"
+	messagesByCaseBucket   = "messages_by_case"
+	messagesByThreadBucket = "messages_by_thread"
+	messagesByTimeBucket   = "messages_by_time"
+	threadsBucket          = "threads"
+	threadMessagesBucket   = "thread_messages"
+	casesBucket            = "cases"
+	openCasesBucket        = "open_cases"
+	metaBucket             = "meta"
+
+	messagesImportedKey = "messages_json_imported"
+)
+
+// MessageStore persists the messages exchanged with Teams users
+type MessageStore interface {
+	Append(row *TeamsMessageRow) error
+	Record(conversationID, tenantID string, row *TeamsMessageRow, newCase bool) error
+	OpenCase(conversationID string) (int, error)
+	CloseCase(caseNumber int) error
+	GetCase(caseNumber int) (*CaseRecord, error)
+	Query(query MessageQuery) ([]TeamsMessageRow, error)
+}
+
+// Case opened by a user question
+type CaseRecord struct {
+	CaseNumber     int       `json:"case_number"`
+	TenantID       string    `json:"tenant_id"`
+	ConversationID string    `json:"conversation_id"`
+	TeamsUserId    string    `json:"teams_user_id"`
+	OpenedAt       time.Time `json:"opened_at"`
+}
+
+// MessageQuery filters stored messages. Zero values match everything.
+type MessageQuery struct {
+	TeamsUserId  string
+	CaseNumber   int
+	ThreadNumber int
+	From         time.Time
+	To           time.Time
+	Limit        int
+}
+
+// Global variables
+var (
+	messageStore MessageStore
+)
+
+// boltMessageStore keeps messages in BoltDB with secondary indexes on user, case, thread and time
+type boltMessageStore struct {
+	db *bolt.DB
+}
+
+// initMessageStore opens the message store and imports any legacy messages.json
+func initMessageStore() {
+	store, err := newBoltMessageStore(db)
+	if err != nil {
+		log.Fatal("Error opening message store:", err)
+	}
+
+	imported, err := store.importMessagesJSON(messagesFile)
+	if err != nil {
+		log.Fatal("Error importing messages:", err)
+	}
+	if imported > 0 {
+		log.Printf("Imported %d messages from %s", imported, messagesFile)
+	}
+
+	messageStore = store
+}
+
+// newBoltMessageStore creates the message buckets if needed
+func newBoltMessageStore(db *bolt.DB) (*boltMessageStore, error) {
+	err := createBuckets(db, messagesBucket, messagesByUserBucket, messagesByCaseBucket, messagesByThreadBucket, messagesByTimeBucket,
+		threadsBucket, threadMessagesBucket, casesBucket, openCasesBucket, metaBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &boltMessageStore{db: db}, nil
+}
+
+// Append stores a message and its index entries in one transaction
+func (s *boltMessageStore) Append(row *TeamsMessageRow) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putMessage(tx, row)
+	})
+}
+
+// Record assigns the case, thread and message numbers of a message in the given conversation
+// and stores it, all in one transaction. Each conversation is one thread whose message numbers
+// increase from 1. A new case is opened when newCase is set, otherwise the message keeps its
+// case number or joins the conversation's open case. tenantID is stored on a newly opened case.
+func (s *boltMessageStore) Record(conversationID, tenantID string, row *TeamsMessageRow, newCase bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		threads := tx.Bucket([]byte(threadsBucket))
+		thread := threads.Get([]byte(conversationID))
+		if thread == nil {
+			number, err := threads.NextSequence()
+			if err != nil {
+				return err
+			}
+			thread = itob(number)
+			if err := threads.Put([]byte(conversationID), thread); err != nil {
+				return err
+			}
+		}
+		row.ThreadNumber = int(btoi(thread))
+
+		openCases := tx.Bucket([]byte(openCasesBucket))
+		if newCase {
+			cases := tx.Bucket([]byte(casesBucket))
+			number, err := cases.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			record, err := json.Marshal(CaseRecord{
+				CaseNumber:     int(number),
+				TenantID:       tenantID,
+				ConversationID: conversationID,
+				TeamsUserId:    row.TeamsUserId,
+				OpenedAt:       row.EventTime,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to marshal case: %w", err)
+			}
+			if err := cases.Put(itob(number), record); err != nil {
+				return err
+			}
+			if err := openCases.Put([]byte(conversationID), itob(number)); err != nil {
+				return err
+			}
+			row.CaseNumber = int(number)
+		} else if row.CaseNumber == 0 {
+			if open := openCases.Get([]byte(conversationID)); open != nil {
+				row.CaseNumber = int(btoi(open))
+			}
+		}
+
+		threadMessages := tx.Bucket([]byte(threadMessagesBucket))
+		last := uint64(0)
+		if value := threadMessages.Get(thread); value != nil {
+			last = btoi(value)
+		}
+		row.MessageNumber = int(last + 1)
+		if err := threadMessages.Put(thread, itob(last+1)); err != nil {
+			return err
+		}
+
+		return putMessage(tx, row)
+	})
+}
+
+// OpenCase returns the case currently open in a conversation, or 0 when there is none
+func (s *boltMessageStore) OpenCase(conversationID string) (int, error) {
+	number := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if open := tx.Bucket([]byte(openCasesBucket)).Get([]byte(conversationID)); open != nil {
+			number = int(btoi(open))
+		}
+		return nil
+	})
+	return number, err
+}
+
+// CloseCase stops a case from being the open case of its conversation
+func (s *boltMessageStore) CloseCase(caseNumber int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(casesBucket)).Get(itob(uint64(caseNumber)))
+		if data == nil {
+			return fmt.Errorf("case %d not found", caseNumber)
+		}
+
+		var record CaseRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("failed to parse case: %w", err)
+		}
+
+		openCases := tx.Bucket([]byte(openCasesBucket))
+		open := openCases.Get([]byte(record.ConversationID))
+		if open == nil || int(btoi(open)) != caseNumber {
+			return nil
+		}
+		return openCases.Delete([]byte(record.ConversationID))
+	})
+}
+
+// GetCase returns a case, or nil when it does not exist
+func (s *boltMessageStore) GetCase(caseNumber int) (*CaseRecord, error) {
+	var record *CaseRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(casesBucket)).Get(itob(uint64(caseNumber)))
+		if data == nil {
+			return nil
+		}
+		record = &CaseRecord{}
+		return json.Unmarshal(data, record)
+	})
+	return record, err
+}
+
+// putMessage writes a message and its index entries within tx
+func putMessage(tx *bolt.Tx, row *TeamsMessageRow) error {
+	messages := tx.Bucket([]byte(messagesBucket))
+	id, err := messages.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if err := messages.Put(itob(id), data); err != nil {
+		return err
+	}
+
+	suffix := append(itob(uint64(row.EventTime.UnixNano())), itob(id)...)
+	indexes := map[string][]byte{
+		messagesByUserBucket:   userIndexPrefix(row.TeamsUserId),
+		messagesByCaseBucket:   itob(uint64(row.CaseNumber)),
+		messagesByThreadBucket: itob(uint64(row.ThreadNumber)),
+		messagesByTimeBucket:   nil,
+	}
+	for bucket, prefix := range indexes {
+		key := append(append([]byte{}, prefix...), suffix...)
+		if err := tx.Bucket([]byte(bucket)).Put(key, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// userIndexPrefix separates the user ID from the time so IDs that prefix each other don't mix
+func userIndexPrefix(userID string) []byte {
+	return append([]byte(userID), 0)
+}
+
+// Query returns messages matching query in time order, using the most selective index
+func (s *boltMessageStore) Query(query MessageQuery) ([]TeamsMessageRow, error) {
+	bucket, prefix := messagesByTimeBucket, []byte{}
+	switch {
+	case query.TeamsUserId != "":
+		bucket, prefix = messagesByUserBucket, userIndexPrefix(query.TeamsUserId)
+	case query.ThreadNumber != 0:
+		bucket, prefix = messagesByThreadBucket, itob(uint64(query.ThreadNumber))
+	case query.CaseNumber != 0:
+		bucket, prefix = messagesByCaseBucket, itob(uint64(query.CaseNumber))
+	}
+
+	var results []TeamsMessageRow
+	err := s.db.View(func(tx *bolt.Tx) error {
+		messages := tx.Bucket([]byte(messagesBucket))
+		cursor := tx.Bucket([]byte(bucket)).Cursor()
+
+		start := prefix
+		if !query.From.IsZero() {
+			start = append(append([]byte{}, prefix...), itob(uint64(query.From.UnixNano()))...)
+		}
+
+		for key, _ := cursor.Seek(start); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			eventTime := time.Unix(0, int64(btoi(key[len(prefix):])))
+			if !query.To.IsZero() && eventTime.After(query.To) {
+				break
+			}
+
+			var row TeamsMessageRow
+			if err := json.Unmarshal(messages.Get(key[len(key)-8:]), &row); err != nil {
+				return fmt.Errorf("failed to parse message: %w", err)
+			}
+			if !query.matches(row) {
+				continue
+			}
+
+			results = append(results, row)
+			if query.Limit > 0 && len(results) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+
+	return results, err
+}
+
+// matches applies the filters that the chosen index did not cover
+func (q MessageQuery) matches(row TeamsMessageRow) bool {
+	if q.TeamsUserId != "" && row.TeamsUserId != q.TeamsUserId {
+		return false
+	}
+	if q.CaseNumber != 0 && row.CaseNumber != q.CaseNumber {
+		return false
+	}
+	if q.ThreadNumber != 0 && row.ThreadNumber != q.ThreadNumber {
+		return false
+	}
+	return true
+}
+
+// importMessagesJSON copies the rows of a legacy messages.json file into the store once
+func (s *boltMessageStore) importMessagesJSON(path string) (int, error) {
+	imported := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if meta.Get([]byte(messagesImportedKey)) != nil {
+			return nil
+		}
+
+		rows, err := readMessagesFile(path)
+		if err != nil {
+			return err
+		}
+
+		// Legacy rows without a time cannot be placed in the time index, so they get the import time
+		importedAt := time.Now()
+		for i := range rows {
+			if rows[i].EventTime.IsZero() {
+				rows[i].EventTime = importedAt
+			}
+			if err := putMessage(tx, &rows[i]); err != nil {
+				return err
+			}
+		}
+		imported = len(rows)
+
+		return meta.Put([]byte(messagesImportedKey), []byte(importedAt.Format(time.RFC3339)))
+	})
+	return imported, err
+}
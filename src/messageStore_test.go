@@ -0,0 +1,269 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestMessageStore opens a message store in a temporary database
+func newTestMessageStore(t *testing.T) *boltMessageStore {
+	t.Helper()
+
+	testDB, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	store, err := newBoltMessageStore(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// messageTexts lists the message text of each row
+func messageTexts(rows []TeamsMessageRow) []string {
+	var texts []string
+	for _, row := range rows {
+		text, _ := row.Message.(string)
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+func TestMessageStoreQuery(t *testing.T) {
+	store := newTestMessageStore(t)
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	// Appended out of time order, with user IDs that prefix each other
+	rows := []TeamsMessageRow{
+		{EventTime: start.Add(2 * time.Hour), TeamsUserId: "u1", CaseNumber: 1, ThreadNumber: 1, Message: "c"},
+		{EventTime: start, TeamsUserId: "u1", CaseNumber: 1, ThreadNumber: 1, Message: "a"},
+		{EventTime: start.Add(time.Hour), TeamsUserId: "u10", CaseNumber: 2, ThreadNumber: 2, Message: "b"},
+		{EventTime: start.Add(3 * time.Hour), TeamsUserId: "u1", CaseNumber: 3, ThreadNumber: 1, Message: "d"},
+	}
+	for i := range rows {
+		if err := store.Append(&rows[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query MessageQuery
+		want  []string
+	}{
+		{"everything in time order", MessageQuery{}, []string{"a", "b", "c", "d"}},
+		{"by user", MessageQuery{TeamsUserId: "u1"}, []string{"a", "c", "d"}},
+		{"by case", MessageQuery{CaseNumber: 1}, []string{"a", "c"}},
+		{"by thread", MessageQuery{ThreadNumber: 1}, []string{"a", "c", "d"}},
+		{"by user and case", MessageQuery{TeamsUserId: "u1", CaseNumber: 3}, []string{"d"}},
+		{"time range", MessageQuery{From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}, []string{"b", "c"}},
+		{"thread in time range", MessageQuery{ThreadNumber: 1, From: start.Add(time.Minute)}, []string{"c", "d"}},
+		{"limit", MessageQuery{TeamsUserId: "u1", Limit: 2}, []string{"a", "c"}},
+		{"no match", MessageQuery{TeamsUserId: "u2"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := store.Query(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := messageTexts(results)
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageStoreImportsMessagesJSONOnce(t *testing.T) {
+	store := newTestMessageStore(t)
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	legacy := `[
+		{"event_time": "2024-06-01T10:00:00Z", "teams_user_id": "u1", "message": "old"},
+		{"teams_user_id": "u1", "message": "no time"}
+	]`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	imported, err := store.importMessagesJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Fatalf("expected 2 imported messages, got %d", imported)
+	}
+
+	imported, err = store.importMessagesJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 0 {
+		t.Errorf("expected the second import to be skipped, got %d", imported)
+	}
+
+	results, err := store.Query(MessageQuery{TeamsUserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageTexts(results); len(got) != 2 || got[0] != "old" || got[1] != "no time" {
+		t.Fatalf("expected both legacy messages in time order, got %v", got)
+	}
+	if results[1].EventTime.Before(before) {
+		t.Errorf("expected a row without a time to get the import time, got %v", results[1].EventTime)
+	}
+
+	results, err = store.Query(MessageQuery{From: before})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageTexts(results); len(got) != 1 || got[0] != "no time" {
+		t.Errorf("expected the row without a time to be found by its import time, got %v", got)
+	}
+}
+
+func TestMessageStoreImportWithoutFile(t *testing.T) {
+	store := newTestMessageStore(t)
+
+	imported, err := store.importMessagesJSON(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || imported != 0 {
+		t.Errorf("expected nothing to import, got %d, %v", imported, err)
+	}
+}
+
+func TestMessageStoreRecordNumbering(t *testing.T) {
+	store := newTestMessageStore(t)
+	now := time.Now()
+
+	record := func(conversationID string, newCase bool) TeamsMessageRow {
+		t.Helper()
+		row := TeamsMessageRow{EventTime: now, TeamsUserId: "user-" + conversationID}
+		if err := store.Record(conversationID, "tenant-1", &row, newCase); err != nil {
+			t.Fatal(err)
+		}
+		return row
+	}
+
+	first := record("a", true)
+	second := record("a", false)
+	other := record("b", true)
+	third := record("a", true)
+	fourth := record("a", false)
+
+	if first.ThreadNumber != second.ThreadNumber || first.ThreadNumber == other.ThreadNumber {
+		t.Errorf("expected one thread per conversation, got %d, %d and %d", first.ThreadNumber, second.ThreadNumber, other.ThreadNumber)
+	}
+	for i, row := range []TeamsMessageRow{first, second, third, fourth} {
+		if row.MessageNumber != i+1 {
+			t.Errorf("message %d of the thread got number %d", i+1, row.MessageNumber)
+		}
+	}
+	if other.MessageNumber != 1 {
+		t.Errorf("expected another conversation to start at message 1, got %d", other.MessageNumber)
+	}
+
+	if second.CaseNumber != first.CaseNumber {
+		t.Errorf("expected a follow-up to join the open case %d, got %d", first.CaseNumber, second.CaseNumber)
+	}
+	if third.CaseNumber == first.CaseNumber || third.CaseNumber == other.CaseNumber {
+		t.Errorf("expected a new case, got %d", third.CaseNumber)
+	}
+	if fourth.CaseNumber != third.CaseNumber {
+		t.Errorf("expected the newest case to be open, got %d", fourth.CaseNumber)
+	}
+
+	open, err := store.OpenCase("a")
+	if err != nil || open != third.CaseNumber {
+		t.Errorf("expected open case %d, got %d, %v", third.CaseNumber, open, err)
+	}
+	caseRecord, err := store.GetCase(third.CaseNumber)
+	if err != nil || caseRecord == nil || caseRecord.TenantID != "tenant-1" || caseRecord.ConversationID != "a" {
+		t.Errorf("unexpected case record %+v, %v", caseRecord, err)
+	}
+
+	results, err := store.Query(MessageQuery{ThreadNumber: first.ThreadNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Errorf("expected 4 messages in the thread, got %d", len(results))
+	}
+}
+
+func TestMessageStoreCloseCase(t *testing.T) {
+	store := newTestMessageStore(t)
+
+	row := TeamsMessageRow{EventTime: time.Now()}
+	if err := store.Record("a", "tenant-1", &row, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CloseCase(row.CaseNumber); err != nil {
+		t.Fatal(err)
+	}
+
+	open, err := store.OpenCase("a")
+	if err != nil || open != 0 {
+		t.Errorf("expected no open case, got %d, %v", open, err)
+	}
+
+	reply := TeamsMessageRow{EventTime: time.Now()}
+	if err := store.Record("a", "tenant-1", &reply, false); err != nil {
+		t.Fatal(err)
+	}
+	if reply.CaseNumber != 0 {
+		t.Errorf("expected a message after the case closed to have no case, got %d", reply.CaseNumber)
+	}
+
+	if err := store.CloseCase(999); err == nil {
+		t.Error("expected closing an unknown case to fail")
+	}
+}
+
+func TestMessageStoreRecordConcurrently(t *testing.T) {
+	store := newTestMessageStore(t)
+
+	const messages = 50
+	var wg sync.WaitGroup
+	for i := 0; i < messages; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			row := TeamsMessageRow{EventTime: time.Now()}
+			if err := store.Record("a", "tenant-1", &row, false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	results, err := store.Query(MessageQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, row := range results {
+		if seen[row.MessageNumber] {
+			t.Fatalf("message number %d assigned twice", row.MessageNumber)
+		}
+		seen[row.MessageNumber] = true
+	}
+	if len(seen) != messages || !seen[1] || !seen[messages] {
+		t.Errorf("expected message numbers 1 to %d, got %d distinct numbers", messages, len(seen))
+	}
+}
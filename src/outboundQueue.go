@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	outboxBucket      = "outbox"
+	deadLettersBucket = "dead_letters"
+
+	defaultOutboxWorkers = 4
+)
+
+// Global variables
+var (
+	outboundQueue *OutboundQueue
+
+	// Retries scheduled by the queue, on top of the quick retries of each send
+	outboxRetryPolicy = retryPolicy{
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    30 * time.Minute,
+	}
+)
+
+// Delivery is an outbound message waiting in the queue or dead-lettered
+type Delivery struct {
+	ID             uint64                 `json:"id"`
+	ConversationID string                 `json:"conversationId"`
+	Payload        map[string]interface{} `json:"payload"`
+	TenantID       string                 `json:"tenantId,omitempty"`
+	CaseID         string                 `json:"caseId,omitempty"`     // Posts in the case's thread once it exists
+	ReportID       string                 `json:"reportId,omitempty"`   // Report that receives the activity ID
+	ActivityID     string                 `json:"activityId,omitempty"` // Activity to update instead of posting a new one
+	Attempts       int                    `json:"attempts"`
+	NextAttemptAt  time.Time              `json:"nextAttemptAt"`
+	LastError      string                 `json:"lastError,omitempty"`
+	CreatedAt      time.Time              `json:"createdAt"`
+	FailedAt       time.Time              `json:"failedAt,omitempty"`
+}
+
+// OutboundQueue delivers messages from a durable outbox with worker goroutines. Deliveries to the
+// same conversation are sent one at a time in the order they were queued.
+type OutboundQueue struct {
+	db       *bolt.DB
+	workers  int
+	jobs     chan *Delivery
+	wake     chan struct{}
+	mu       sync.Mutex
+	inFlight map[string]bool
+	deliver  func(delivery *Delivery) error
+}
+
+// initOutboundQueue opens the outbox and starts delivering
+func initOutboundQueue() {
+	workers := defaultOutboxWorkers
+	if value := os.Getenv("OUTBOX_WORKERS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatal("OUTBOX_WORKERS must be a positive number")
+		}
+		workers = n
+	}
+
+	queue, err := newOutboundQueue(db, workers)
+	if err != nil {
+		log.Fatal("Error opening outbound queue:", err)
+	}
+	queue.Start()
+	outboundQueue = queue
+}
+
+// newOutboundQueue creates the outbox buckets if needed
+func newOutboundQueue(db *bolt.DB, workers int) (*OutboundQueue, error) {
+	err := createBuckets(db, outboxBucket, deadLettersBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &OutboundQueue{
+		db:       db,
+		workers:  workers,
+		jobs:     make(chan *Delivery, workers),
+		wake:     make(chan struct{}, 1),
+		inFlight: make(map[string]bool),
+		deliver:  deliver,
+	}, nil
+}
+
+// Start runs the scheduler and workers in the background
+func (q *OutboundQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+	go q.schedule()
+}
+
+// Enqueue stores a delivery in the outbox and wakes the scheduler
+func (q *OutboundQueue) Enqueue(delivery *Delivery) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket([]byte(outboxBucket))
+		id, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		delivery.ID = id
+		delivery.CreatedAt = time.Now()
+		delivery.NextAttemptAt = delivery.CreatedAt
+		return putDelivery(outbox, delivery)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to queue delivery: %w", err)
+	}
+
+	q.notify()
+	return nil
+}
+
+// DeadLetters lists deliveries that failed for good
+func (q *OutboundQueue) DeadLetters() ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deadLettersBucket)).ForEach(func(_, data []byte) error {
+			var delivery Delivery
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+			return nil
+		})
+	})
+	return deliveries, err
+}
+
+// Replay moves a dead-lettered delivery back to the end of the outbox with a fresh retry budget
+func (q *OutboundQueue) Replay(id uint64) (*Delivery, error) {
+	var delivery *Delivery
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		deadLetters := tx.Bucket([]byte(deadLettersBucket))
+		data := deadLetters.Get(itob(id))
+		if data == nil {
+			return nil
+		}
+
+		delivery = &Delivery{}
+		if err := json.Unmarshal(data, delivery); err != nil {
+			return err
+		}
+		if err := deadLetters.Delete(itob(id)); err != nil {
+			return err
+		}
+
+		outbox := tx.Bucket([]byte(outboxBucket))
+		newID, err := outbox.NextSequence()
+		if err != nil {
+			return err
+		}
+		delivery.ID = newID
+		delivery.Attempts = 0
+		delivery.NextAttemptAt = time.Now()
+		delivery.FailedAt = time.Time{}
+		return putDelivery(outbox, delivery)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay delivery: %w", err)
+	}
+
+	if delivery != nil {
+		q.notify()
+	}
+	return delivery, nil
+}
+
+// notify wakes the scheduler without blocking
+func (q *OutboundQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands ready deliveries to the workers whenever something changes or a retry comes due
+func (q *OutboundQueue) schedule() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		q.dispatchReady()
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchReady sends the oldest delivery of every idle conversation to the workers once it is due
+func (q *OutboundQueue) dispatchReady() {
+	var ready []*Delivery
+	err := q.db.View(func(tx *bolt.Tx) error {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		seen := make(map[string]bool)
+		now := time.Now()
+		return tx.Bucket([]byte(outboxBucket)).ForEach(func(key, data []byte) error {
+			// A corrupt entry is skipped rather than holding up every other conversation
+			var delivery Delivery
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				log.Printf("Skipping unreadable outbox entry %d: %v", btoi(key), err)
+				return nil
+			}
+
+			// Only the oldest delivery of a conversation may go out
+			if seen[delivery.ConversationID] {
+				return nil
+			}
+			seen[delivery.ConversationID] = true
+
+			if q.inFlight[delivery.ConversationID] || delivery.NextAttemptAt.After(now) {
+				return nil
+			}
+			q.inFlight[delivery.ConversationID] = true
+			ready = append(ready, &delivery)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to read outbox: %v", err)
+	}
+
+	for _, delivery := range ready {
+		q.jobs <- delivery
+	}
+}
+
+// work delivers messages handed out by the scheduler
+func (q *OutboundQueue) work() {
+	for delivery := range q.jobs {
+		err := q.deliver(delivery)
+		if err != nil {
+			log.Printf("Delivery %d to %s failed: %v", delivery.ID, delivery.ConversationID, err)
+		}
+
+		err = q.complete(delivery, err)
+		if err != nil {
+			log.Printf("Failed to update delivery %d: %v", delivery.ID, err)
+		}
+
+		q.mu.Lock()
+		delete(q.inFlight, delivery.ConversationID)
+		q.mu.Unlock()
+		q.notify()
+	}
+}
+
+// complete removes a delivered message from the outbox, or schedules its retry, or dead-letters it
+func (q *OutboundQueue) complete(delivery *Delivery, sendErr error) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket([]byte(outboxBucket))
+		if sendErr == nil {
+			return outbox.Delete(itob(delivery.ID))
+		}
+
+		delivery.Attempts++
+		delivery.LastError = sendErr.Error()
+
+		if !isRetryable(sendErr) || delivery.Attempts >= outboxRetryPolicy.MaxAttempts {
+			log.Printf("Delivery %d to %s moved to dead letters after %d attempts", delivery.ID, delivery.ConversationID, delivery.Attempts)
+			delivery.FailedAt = time.Now()
+			if err := outbox.Delete(itob(delivery.ID)); err != nil {
+				return err
+			}
+			return putDelivery(tx.Bucket([]byte(deadLettersBucket)), delivery)
+		}
+
+		var retryAfter time.Duration
+		var sendError *SendError
+		if errors.As(sendErr, &sendError) {
+			retryAfter = sendError.RetryAfter
+		}
+		delivery.NextAttemptAt = time.Now().Add(outboxRetryPolicy.delay(delivery.Attempts, retryAfter))
+		return putDelivery(outbox, delivery)
+	})
+}
+
+// deliver posts a delivery and records the resulting activity on its report
+func deliver(delivery *Delivery) error {
+	if delivery.ActivityID != "" {
+		return deliverUpdate(delivery)
+	}
+
+	conversationID, activityID, err := postCaseActivity(delivery.TenantID, reportThreadID(delivery.CaseID), delivery.ConversationID, delivery.Payload)
+	if err != nil {
+		return err
+	}
+
+	if delivery.ReportID == "" {
+		return nil
+	}
+
+	// Without the activity ID on its report the card could never be updated or deleted, so it is removed again
+	posted, err := reportStore.Get(delivery.ReportID)
+	if err == nil && posted == nil {
+		log.Printf("Report %s was deleted before its card was delivered", delivery.ReportID)
+		removeDeliveredCard(delivery, conversationID, activityID)
+		return nil
+	}
+	if err == nil {
+		posted.ConversationID = conversationID
+		posted.ActivityID = activityID
+		posted.UpdatedAt = time.Now()
+		err = reportStore.Save(posted)
+	}
+	if err != nil {
+		removeDeliveredCard(delivery, conversationID, activityID)
+		return fmt.Errorf("%w: %v", errReportNotSaved, err)
+	}
+	return nil
+}
+
+// removeDeliveredCard deletes a card whose report could not record it
+func removeDeliveredCard(delivery *Delivery, conversationID, activityID string) {
+	err := removeCaseActivity(delivery.TenantID, reportThreadID(delivery.CaseID), conversationID, activityID)
+	if err != nil {
+		log.Printf("Failed to remove card of report %s: %v", delivery.ReportID, err)
+	}
+}
+
+// deliverUpdate replaces an activity. For a report the card is rendered from its current state
+// at delivery time, so updates queued out of order still leave the latest card in place.
+func deliverUpdate(delivery *Delivery) error {
+	payload := delivery.Payload
+	if delivery.ReportID != "" {
+		posted, err := reportStore.Get(delivery.ReportID)
+		if err != nil {
+			return fmt.Errorf("failed to load report %s: %w", delivery.ReportID, err)
+		}
+		if posted == nil {
+			log.Printf("Report %s was deleted before its card was updated", delivery.ReportID)
+			return nil
+		}
+		payload = createPostedReportCard(posted, "")
+	}
+	return updateActivity(delivery.ConversationID, delivery.ActivityID, payload)
+}
+
+// putDelivery stores a delivery under its ID
+func putDelivery(bucket *bolt.Bucket, delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+	return bucket.Put(itob(delivery.ID), data)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestQueue opens an outbox in a temporary database. The queue is not started.
+func newTestQueue(t *testing.T, workers int) *OutboundQueue {
+	t.Helper()
+
+	testDB, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	queue, err := newOutboundQueue(testDB, workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.deliver = func(*Delivery) error {
+		t.Error("unexpected delivery")
+		return nil
+	}
+	return queue
+}
+
+// pendingDeliveries lists the deliveries still in the outbox
+func pendingDeliveries(t *testing.T, q *OutboundQueue) []Delivery {
+	t.Helper()
+
+	var deliveries []Delivery
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(outboxBucket)).ForEach(func(_, data []byte) error {
+			var delivery Delivery
+			if err := json.Unmarshal(data, &delivery); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestOutboundQueueDispatchesOldestPerConversation(t *testing.T) {
+	q := newTestQueue(t, 4)
+
+	for _, conversationID := range []string{"a", "a", "b", "a"} {
+		if err := q.Enqueue(&Delivery{ConversationID: conversationID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.dispatchReady()
+	close(q.jobs)
+
+	var dispatched []uint64
+	for delivery := range q.jobs {
+		dispatched = append(dispatched, delivery.ID)
+	}
+	if len(dispatched) != 2 || dispatched[0] != 1 || dispatched[1] != 3 {
+		t.Fatalf("expected deliveries 1 and 3 to be dispatched, got %v", dispatched)
+	}
+}
+
+func TestOutboundQueueSkipsConversationsInFlight(t *testing.T) {
+	q := newTestQueue(t, 4)
+
+	if err := q.Enqueue(&Delivery{ConversationID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	q.inFlight["a"] = true
+
+	q.dispatchReady()
+	if len(q.jobs) != 0 {
+		t.Fatalf("expected nothing to be dispatched while the conversation is busy, got %d", len(q.jobs))
+	}
+}
+
+func TestOutboundQueueSkipsUnreadableEntries(t *testing.T) {
+	q := newTestQueue(t, 4)
+
+	corrupt := &Delivery{ConversationID: "a"}
+	if err := q.Enqueue(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(outboxBucket)).Put(itob(corrupt.ID), []byte("{not json"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&Delivery{ConversationID: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.dispatchReady()
+	if len(q.jobs) != 1 {
+		t.Fatalf("expected the readable delivery to be dispatched, got %d", len(q.jobs))
+	}
+	if delivery := <-q.jobs; delivery.ConversationID != "b" {
+		t.Errorf("expected the delivery to b, got %+v", delivery)
+	}
+}
+
+func TestOutboundQueueComplete(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		attempts       int
+		wantPending    bool
+		wantDeadLetter bool
+	}{
+		{"delivered", nil, 0, false, false},
+		{"retryable failure", &SendError{Retryable: true, Err: errors.New("busy")}, 0, true, false},
+		{"permanent failure", &SendError{StatusCode: 400, Err: errors.New("bad request")}, 0, false, true},
+		{"plain error", errors.New("no such report"), 0, false, true},
+		{"retries exhausted", &SendError{Retryable: true, Err: errors.New("busy")}, outboxRetryPolicy.MaxAttempts - 1, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, 1)
+			delivery := &Delivery{ConversationID: "a"}
+			if err := q.Enqueue(delivery); err != nil {
+				t.Fatal(err)
+			}
+			delivery.Attempts = tt.attempts
+
+			if err := q.complete(delivery, tt.err); err != nil {
+				t.Fatal(err)
+			}
+
+			pending := pendingDeliveries(t, q)
+			if (len(pending) == 1) != tt.wantPending {
+				t.Fatalf("expected pending=%v, got %d deliveries in the outbox", tt.wantPending, len(pending))
+			}
+			if tt.wantPending {
+				if pending[0].Attempts != tt.attempts+1 || !pending[0].NextAttemptAt.After(time.Now()) {
+					t.Errorf("expected a scheduled retry, got attempts=%d next=%v", pending[0].Attempts, pending[0].NextAttemptAt)
+				}
+				if pending[0].LastError == "" {
+					t.Error("expected the last error to be recorded")
+				}
+			}
+
+			deadLetters, err := q.DeadLetters()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(deadLetters) == 1) != tt.wantDeadLetter {
+				t.Fatalf("expected dead letter=%v, got %d", tt.wantDeadLetter, len(deadLetters))
+			}
+			if tt.wantDeadLetter && deadLetters[0].FailedAt.IsZero() {
+				t.Error("expected FailedAt to be set on the dead letter")
+			}
+		})
+	}
+}
+
+func TestOutboundQueueRetryHonoursRetryAfter(t *testing.T) {
+	q := newTestQueue(t, 1)
+	delivery := &Delivery{ConversationID: "a"}
+	if err := q.Enqueue(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	err := q.complete(delivery, &SendError{Retryable: true, RetryAfter: 10 * time.Minute, Err: errors.New("throttled")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := pendingDeliveries(t, q)
+	if len(pending) != 1 || time.Until(pending[0].NextAttemptAt) < 9*time.Minute {
+		t.Fatalf("expected the retry to wait for Retry-After, got %+v", pending)
+	}
+}
+
+func TestOutboundQueueReplay(t *testing.T) {
+	q := newTestQueue(t, 1)
+	delivery := &Delivery{ConversationID: "a"}
+	if err := q.Enqueue(delivery); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.complete(delivery, errors.New("permanent")); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := q.Replay(delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed == nil || replayed.ID == delivery.ID || replayed.Attempts != 0 || !replayed.FailedAt.IsZero() {
+		t.Fatalf("expected a fresh delivery with a new ID, got %+v", replayed)
+	}
+
+	deadLetters, err := q.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 0 {
+		t.Errorf("expected the dead letter to be removed, got %d", len(deadLetters))
+	}
+	if pending := pendingDeliveries(t, q); len(pending) != 1 || pending[0].ID != replayed.ID {
+		t.Errorf("expected the replayed delivery in the outbox, got %+v", pending)
+	}
+
+	missing, err := q.Replay(999)
+	if err != nil || missing != nil {
+		t.Errorf("expected nil for an unknown dead letter, got %+v, %v", missing, err)
+	}
+}
+
+func TestOutboundQueueDeliversInOrder(t *testing.T) {
+	q := newTestQueue(t, 4)
+
+	var mu sync.Mutex
+	delivered := make(map[string][]uint64)
+	done := make(chan struct{})
+	q.deliver = func(delivery *Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[delivery.ConversationID] = append(delivered[delivery.ConversationID], delivery.ID)
+		if len(delivered["a"])+len(delivered["b"]) == 6 {
+			close(done)
+		}
+		return nil
+	}
+
+	for _, conversationID := range []string{"a", "b", "a", "b", "a", "b"} {
+		if err := q.Enqueue(&Delivery{ConversationID: conversationID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Start()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for deliveries")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := delivered["a"]; len(got) != 3 || got[0] != 1 || got[1] != 3 || got[2] != 5 {
+		t.Errorf("conversation a delivered out of order: %v", got)
+	}
+	if got := delivered["b"]; len(got) != 3 || got[0] != 2 || got[1] != 4 || got[2] != 6 {
+		t.Errorf("conversation b delivered out of order: %v", got)
+	}
+}
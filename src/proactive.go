@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Request to message a user who may never have talked to the bot
+type NotificationRequest struct {
+	TenantID    string `json:"tenantId"`
+	AADObjectID string `json:"aadObjectId,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Text        string `json:"text"`
+}
+
+// resolveAADObjectID returns the AAD object ID of a user given either the ID itself or an email address
+func resolveAADObjectID(tenantID, aadObjectID, email string) (string, error) {
+	if aadObjectID != "" {
+		return aadObjectID, nil
+	}
+	if email == "" {
+		return "", fmt.Errorf("an AAD object ID or email is required")
+	}
+
+	var user struct {
+		ID string `json:"id"`
+	}
+	client, err := newTenantGraphClient(tenantID)
+	if err != nil {
+		return "", err
+	}
+	err = client.Get("/users/"+url.PathEscape(email)+"?$select=id", &user)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", email, err)
+	}
+	return user.ID, nil
+}
+
+// getPersonalConversation returns the cached 1:1 conversation with a user, creating it when needed
+func getPersonalConversation(tenantID, aadObjectID string) (*ConversationReference, error) {
+	ref, err := contactStore.GetConversationRef(tenantID, aadObjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load conversation reference: %w", err)
+	}
+	if ref != nil {
+		rememberConversationServiceURL(ref.ConversationID, ref.ServiceURL)
+		return ref, nil
+	}
+
+	serviceURL := getDefaultServiceURL()
+	integration, err := FindIntegration(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if integration != nil && integration.Integration.Teams.ServiceURL != "" {
+		serviceURL = integration.Integration.Teams.ServiceURL
+	}
+
+	conversationID, err := createPersonalConversation(serviceURL, tenantID, aadObjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	ref = &ConversationReference{
+		TenantID:       tenantID,
+		AADObjectID:    aadObjectID,
+		ConversationID: conversationID,
+		ServiceURL:     serviceURL,
+		CreatedAt:      time.Now(),
+	}
+	err = contactStore.SaveConversationRef(ref)
+	if err != nil {
+		log.Printf("Failed to cache conversation with %s: %v", aadObjectID, err)
+	}
+	rememberConversationServiceURL(conversationID, serviceURL)
+
+	return ref, nil
+}
+
+// createPersonalConversation starts a 1:1 conversation through the Bot Connector createConversation endpoint
+func createPersonalConversation(serviceURL, tenantID, aadObjectID string) (string, error) {
+	payload := map[string]interface{}{
+		"bot": map[string]string{
+			"id": "28:" + os.Getenv("BOT_ID"),
+		},
+		"members": []map[string]string{
+			{"id": aadObjectID},
+		},
+		"channelData": map[string]interface{}{
+			"tenant": map[string]string{"id": tenantID},
+		},
+		"tenantId": tenantID,
+		"isGroup":  false,
+	}
+
+	body, err := botConnectorRequest("POST", strings.TrimSuffix(serviceURL, "/")+"/v3/conversations", payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to create conversation: %w", err)
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil || result.ID == "" {
+		return "", fmt.Errorf("invalid create conversation response: %s", string(body))
+	}
+	return result.ID, nil
+}
+
+// sendProactiveMessage messages a user in their 1:1 chat with the bot, starting the chat if needed
+func sendProactiveMessage(tenantID, aadObjectID, email string, payload map[string]interface{}) (string, string, error) {
+	aadObjectID, err := resolveAADObjectID(tenantID, aadObjectID, email)
+	if err != nil {
+		return "", "", err
+	}
+
+	ref, err := getPersonalConversation(tenantID, aadObjectID)
+	if err != nil {
+		return "", "", err
+	}
+
+	activityID, err := postActivity(ref.ConversationID, payload)
+	if err != nil {
+		return "", "", err
+	}
+	return ref.ConversationID, activityID, nil
+}
+
+// createNotificationAPIHandler sends a proactive message to a user identified by AAD object ID or email
+func createNotificationAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var notification NotificationRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&notification)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid notification: "+err.Error())
+		return
+	}
+	if notification.TenantID == "" || strings.TrimSpace(notification.Text) == "" {
+		writeJSONError(w, http.StatusBadRequest, "tenantId and text are required")
+		return
+	}
+	if notification.AADObjectID == "" && notification.Email == "" {
+		writeJSONError(w, http.StatusBadRequest, "aadObjectId or email is required")
+		return
+	}
+
+	conversationID, activityID, err := sendProactiveMessage(notification.TenantID, notification.AADObjectID, notification.Email, map[string]interface{}{
+		"type": "message",
+		"text": notification.Text,
+	})
+	if err != nil {
+		log.Printf("Failed to notify user in tenant %s: %v", notification.TenantID, err)
+		writeJSONError(w, sendFailureStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ReportResponse{
+		ActivityID:     activityID,
+		ConversationID: conversationID,
+	})
+}
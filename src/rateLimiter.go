@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConversationRate  = 7.0
+	defaultConversationBurst = 7
+	defaultGlobalRate        = 50.0
+	defaultGlobalBurst       = 50
+
+	// Buckets of conversations that have been quiet this long are dropped
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+// Global variables
+var (
+	sendLimiter *SendLimiter
+)
+
+// initSendLimiter sets up pacing for all messages sent through the Bot Connector
+func initSendLimiter() {
+	sendLimiter = newSendLimiter()
+}
+
+// tokenBucket allows rate events per second with bursts of up to burst events
+type tokenBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	now := time.Now()
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now, lastUsed: now}
+}
+
+// reserve takes a token and returns how long the caller must wait before using it
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.lastUsed = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// SendLimiter paces Bot Connector sends per conversation and overall
+type SendLimiter struct {
+	mu                sync.Mutex
+	global            *tokenBucket
+	conversations     map[string]*tokenBucket
+	conversationRate  float64
+	conversationBurst int
+	lastCleanup       time.Time
+}
+
+// newSendLimiter reads the limits from BOT_CONVERSATION_RATE, BOT_CONVERSATION_BURST,
+// BOT_GLOBAL_RATE and BOT_GLOBAL_BURST, with rates in messages per second
+func newSendLimiter() *SendLimiter {
+	conversationRate := envFloat("BOT_CONVERSATION_RATE", defaultConversationRate)
+	conversationBurst := int(envFloat("BOT_CONVERSATION_BURST", defaultConversationBurst))
+	globalRate := envFloat("BOT_GLOBAL_RATE", defaultGlobalRate)
+	globalBurst := int(envFloat("BOT_GLOBAL_BURST", defaultGlobalBurst))
+
+	return &SendLimiter{
+		global:            newTokenBucket(globalRate, globalBurst),
+		conversations:     make(map[string]*tokenBucket),
+		conversationRate:  conversationRate,
+		conversationBurst: conversationBurst,
+		lastCleanup:       time.Now(),
+	}
+}
+
+// Wait blocks until a message may be sent to the conversation
+func (l *SendLimiter) Wait(conversationID string) {
+	l.mu.Lock()
+	now := time.Now()
+	l.cleanup(now)
+
+	// Requests that are not tied to a conversation only count against the global limit
+	var wait time.Duration
+	if conversationID != "" {
+		bucket, ok := l.conversations[conversationID]
+		if !ok {
+			bucket = newTokenBucket(l.conversationRate, l.conversationBurst)
+			l.conversations[conversationID] = bucket
+		}
+		wait = bucket.reserve(now)
+	}
+	if globalWait := l.global.reserve(now); globalWait > wait {
+		wait = globalWait
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// cleanup forgets conversations that have not been used recently
+func (l *SendLimiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < limiterIdleTimeout {
+		return
+	}
+	for id, bucket := range l.conversations {
+		if now.Sub(bucket.lastUsed) > limiterIdleTimeout {
+			delete(l.conversations, id)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// limiterKey returns the conversation a Bot Connector URL sends to. Replies in a channel
+// thread count against the channel.
+func limiterKey(url string) string {
+	parts := strings.SplitN(url, "/v3/conversations/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	conversationID := strings.SplitN(parts[1], "/", 2)[0]
+	return strings.SplitN(conversationID, ";", 2)[0]
+}
+
+// envFloat reads a positive number from the environment, falling back to def
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %v", name, value, def)
+		return def
+	}
+	return n
+}
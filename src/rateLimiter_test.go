@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	bucket := &tokenBucket{rate: 2, burst: 3, tokens: 3, last: start, lastUsed: start}
+
+	// The burst is available immediately
+	for i := 0; i < 3; i++ {
+		if wait := bucket.reserve(start); wait != 0 {
+			t.Fatalf("send %d: expected no wait within the burst, got %v", i+1, wait)
+		}
+	}
+
+	// Further sends wait for tokens at the configured rate
+	if wait := bucket.reserve(start); wait != 500*time.Millisecond {
+		t.Errorf("expected 500ms wait, got %v", wait)
+	}
+	if wait := bucket.reserve(start); wait != time.Second {
+		t.Errorf("expected 1s wait for the second queued send, got %v", wait)
+	}
+
+	// An idle bucket refills but never beyond its burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if wait := bucket.reserve(later); wait != 0 {
+			t.Fatalf("send %d after idle: expected no wait, got %v", i+1, wait)
+		}
+	}
+	if wait := bucket.reserve(later); wait == 0 {
+		t.Error("expected the refilled bucket to be capped at its burst")
+	}
+}
+
+func TestSendLimiterWait(t *testing.T) {
+	t.Setenv("BOT_CONVERSATION_RATE", "20")
+	t.Setenv("BOT_CONVERSATION_BURST", "2")
+	t.Setenv("BOT_GLOBAL_RATE", "1000")
+	t.Setenv("BOT_GLOBAL_BURST", "1000")
+	limiter := newSendLimiter()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		limiter.Wait("a")
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected sends beyond the burst to be paced, took %v", elapsed)
+	}
+
+	// Other conversations have their own bucket
+	start = time.Now()
+	limiter.Wait("b")
+	limiter.Wait("b")
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("expected conversation b not to wait on a, took %v", elapsed)
+	}
+}
+
+func TestSendLimiterGlobalLimit(t *testing.T) {
+	t.Setenv("BOT_CONVERSATION_RATE", "1000")
+	t.Setenv("BOT_CONVERSATION_BURST", "1000")
+	t.Setenv("BOT_GLOBAL_RATE", "20")
+	t.Setenv("BOT_GLOBAL_BURST", "2")
+	limiter := newSendLimiter()
+
+	start := time.Now()
+	limiter.Wait("a")
+	limiter.Wait("b")
+	limiter.Wait("")
+	limiter.Wait("c")
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected the global limit to pace sends across conversations, took %v", elapsed)
+	}
+	if _, ok := limiter.conversations[""]; ok {
+		t.Error("sends without a conversation must not get a conversation bucket")
+	}
+}
+
+func TestSendLimiterCleanup(t *testing.T) {
+	limiter := newSendLimiter()
+	limiter.Wait("a")
+
+	limiter.cleanup(time.Now().Add(2 * limiterIdleTimeout))
+	if len(limiter.conversations) != 0 {
+		t.Errorf("expected idle conversations to be dropped, got %d", len(limiter.conversations))
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://smba.trafficmanager.net/amer/v3/conversations/a:123/activities", "a:123"},
+		{"https://smba.trafficmanager.net/amer/v3/conversations/19:abc@thread.tacv2;messageid=42/activities", "19:abc@thread.tacv2"},
+		{"https://smba.trafficmanager.net/amer/v3/conversations/a:123/activities/1", "a:123"},
+		{"https://smba.trafficmanager.net/amer/v3/conversations", ""},
+		{"https://login.microsoftonline.com/token", ""},
+	}
+
+	for _, tt := range tests {
+		if got := limiterKey(tt.url); got != tt.want {
+			t.Errorf("limiterKey(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestEnvFloat(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"", 7},
+		{"2.5", 2.5},
+		{"fast", 7},
+		{"0", 7},
+		{"-1", 7},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("TEST_RATE", tt.value)
+		if got := envFloat("TEST_RATE", 7); got != tt.want {
+			t.Errorf("envFloat(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
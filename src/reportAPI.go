@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Severity of an investigation report
+type Severity string
+
+const (
+	SeverityInformational Severity = "Informational"
+	SeverityLow           Severity = "Low"
+	SeverityMedium        Severity = "Medium"
+	SeverityHigh          Severity = "High"
+	SeverityCritical      Severity = "Critical"
+)
+
+// Status of an investigation report
+type ReportStatus string
+
+const (
+	ReportStatusOpen     ReportStatus = "Open"
+	ReportStatusResolved ReportStatus = "Resolved"
+)
+
+// Investigation report posted by the detection pipeline
+type InvestigationReport struct {
+	TenantID    string       `json:"tenantId"`
+	CaseID      string       `json:"caseId,omitempty"`
+	Title       string       `json:"title"`
+	Time        time.Time    `json:"time"`
+	Severity    Severity     `json:"severity"`
+	Status      ReportStatus `json:"status,omitempty"`
+	Description string       `json:"description"`
+	Indicators  []Indicator  `json:"indicators,omitempty"`
+	Links       []ReportLink `json:"links,omitempty"`
+}
+
+// Indicator of compromise found during an investigation
+type Indicator struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Link to more details about an investigation
+type ReportLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// Response returned once a report has been posted
+type ReportResponse struct {
+	ReportID       string `json:"reportId"`
+	ActivityID     string `json:"activityId"`
+	ConversationID string `json:"conversationId"`
+}
+
+// validate checks that the report has everything needed to render it
+func (r InvestigationReport) validate() error {
+	if r.TenantID == "" {
+		return fmt.Errorf("tenantId is required")
+	}
+	if strings.TrimSpace(r.Title) == "" {
+		return fmt.Errorf("title is required")
+	}
+	if r.Time.IsZero() {
+		return fmt.Errorf("time is required")
+	}
+	switch r.Severity {
+	case SeverityInformational, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical:
+	default:
+		return fmt.Errorf("severity must be one of Informational, Low, Medium, High or Critical")
+	}
+	switch r.Status {
+	case "", ReportStatusOpen, ReportStatusResolved:
+	default:
+		return fmt.Errorf("status must be Open or Resolved")
+	}
+	if strings.TrimSpace(r.Description) == "" {
+		return fmt.Errorf("description is required")
+	}
+	for i, indicator := range r.Indicators {
+		if indicator.Type == "" || indicator.Value == "" {
+			return fmt.Errorf("indicators[%d] needs a type and a value", i)
+		}
+	}
+	for i, link := range r.Links {
+		u, err := url.Parse(link.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("links[%d] needs an absolute http(s) url", i)
+		}
+		if link.Title == "" {
+			return fmt.Errorf("links[%d] needs a title", i)
+		}
+	}
+	return nil
+}
+
+// requireAPIKey only lets requests through that carry the REPORTS_API_KEY bearer token
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey := os.Getenv("REPORTS_API_KEY")
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if apiKey == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid or missing API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// decodeReport reads and validates a JSON report from the request body
+func decodeReport(r *http.Request) (InvestigationReport, error) {
+	var report InvestigationReport
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&report)
+	if err != nil {
+		return report, fmt.Errorf("invalid report: %w", err)
+	}
+	return report, report.validate()
+}
+
+// createReportAPIHandler validates a JSON report and posts it to the tenant's Reports channel
+func createReportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := decodeReport(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := getReportsChannelID(report.TenantID); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	posted, err := postReport(report)
+	if err != nil {
+		log.Printf("Failed to post report for tenant %s: %v", report.TenantID, err)
+		status := sendFailureStatus(err)
+		if errors.Is(err, errReportNotSaved) {
+			status = http.StatusInternalServerError
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ReportResponse{
+		ReportID:       posted.ID,
+		ActivityID:     posted.ActivityID,
+		ConversationID: posted.ConversationID,
+	})
+}
+
+// Returned by postReport when the card was posted but the report could not be saved. The card
+// is removed again, since without the saved report it could never be updated or deleted.
+var errReportNotSaved = errors.New("report could not be saved")
+
+// postReport sends a report to the tenant's Reports channel and saves it with its activity ID
+// so the card can be triaged, updated or deleted later
+func postReport(report InvestigationReport) (*PostedReport, error) {
+	channelID, err := getReportsChannelID(report.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	posted := &PostedReport{
+		ID:        generateID(),
+		Report:    report,
+		Triage:    TriageStateNew,
+		PostedAt:  time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	posted.ConversationID, posted.ActivityID, err = postCaseActivity(report.TenantID, reportThreadID(report.CaseID), channelID, createPostedReportCard(posted, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	err = reportStore.Save(posted)
+	if err != nil {
+		if removeErr := removeCaseActivity(report.TenantID, reportThreadID(report.CaseID), posted.ConversationID, posted.ActivityID); removeErr != nil {
+			log.Printf("Failed to remove card of unsaved report %s: %v", posted.ID, removeErr)
+		}
+		return nil, fmt.Errorf("%w: %v", errReportNotSaved, err)
+	}
+
+	return posted, nil
+}
+
+// removeCaseActivity deletes an activity posted by postCaseActivity. When it was the root of
+// its case thread the thread is forgotten too, so later posts of the case start a new one.
+func removeCaseActivity(tenantID, threadID, conversationID, activityID string) error {
+	err := deleteActivity(conversationID, activityID)
+	if err != nil {
+		return err
+	}
+
+	if threadID == "" {
+		return nil
+	}
+	thread, err := reportStore.GetCaseThread(tenantID, threadID)
+	if err != nil {
+		return fmt.Errorf("failed to load case thread: %w", err)
+	}
+	if thread != nil && thread.RootActivityID == activityID {
+		err = reportStore.DeleteCaseThread(tenantID, threadID)
+		if err != nil {
+			return fmt.Errorf("failed to delete case thread: %w", err)
+		}
+	}
+	return nil
+}
+
+// Follow-up note posted to a case's thread
+type CaseFollowUp struct {
+	TenantID string `json:"tenantId"`
+	Text     string `json:"text"`
+}
+
+// createFollowUpAPIHandler posts a follow-up note as a reply in the case's report thread
+func createFollowUpAPIHandler(w http.ResponseWriter, r *http.Request) {
+	caseID := mux.Vars(r)["caseId"]
+
+	var followUp CaseFollowUp
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&followUp)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid follow-up: "+err.Error())
+		return
+	}
+	if followUp.TenantID == "" || strings.TrimSpace(followUp.Text) == "" {
+		writeJSONError(w, http.StatusBadRequest, "tenantId and text are required")
+		return
+	}
+
+	thread, err := reportStore.GetCaseThread(followUp.TenantID, reportThreadID(caseID))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load case thread: "+err.Error())
+		return
+	}
+	if thread == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("case %s has no report thread", caseID))
+		return
+	}
+
+	activityID, err := postActivity(thread.ConversationID(), map[string]interface{}{
+		"type": "message",
+		"text": followUp.Text,
+	})
+	if err != nil {
+		log.Printf("Failed to post follow-up for case %s: %v", caseID, err)
+		writeJSONError(w, sendFailureStatus(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ReportResponse{
+		ActivityID:     activityID,
+		ConversationID: thread.ConversationID(),
+	})
+}
+
+// postCaseActivity posts an activity for a case thread. The first post of a thread starts it
+// in the Reports channel, later posts are replies in that thread. Without a thread ID the activity
+// is always posted at the top level. Returns the conversation and activity IDs of the post.
+func postCaseActivity(tenantID, threadID, channelID string, payload map[string]interface{}) (string, string, error) {
+	if threadID == "" {
+		activityID, err := postActivity(channelID, payload)
+		return channelID, activityID, err
+	}
+
+	thread, err := reportStore.GetCaseThread(tenantID, threadID)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load case thread: %w", err)
+	}
+	if thread != nil {
+		activityID, err := postActivity(thread.ConversationID(), payload)
+		return thread.ConversationID(), activityID, err
+	}
+
+	activityID, err := postActivity(channelID, payload)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = reportStore.SaveCaseThread(&CaseThread{
+		TenantID:       tenantID,
+		ThreadID:       threadID,
+		ChannelID:      channelID,
+		RootActivityID: activityID,
+		CreatedAt:      time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to save case thread %s: %v", threadID, err)
+	}
+
+	return channelID, activityID, nil
+}
+
+// queueReport saves a report and queues its card for delivery to the tenant's Reports channel.
+// The activity ID is filled in on the saved report once the card has been delivered.
+func queueReport(report InvestigationReport) (*PostedReport, error) {
+	channelID, err := getReportsChannelID(report.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	posted := &PostedReport{
+		ID:        generateID(),
+		Report:    report,
+		Triage:    TriageStateNew,
+		PostedAt:  time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	err = reportStore.Save(posted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save report: %w", err)
+	}
+
+	err = outboundQueue.Enqueue(&Delivery{
+		ConversationID: channelID,
+		Payload:        createPostedReportCard(posted, ""),
+		TenantID:       report.TenantID,
+		CaseID:         report.CaseID,
+		ReportID:       posted.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return posted, nil
+}
+
+// listDeadLettersAPIHandler lists deliveries that failed for good
+func listDeadLettersAPIHandler(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := outboundQueue.DeadLetters()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list failed deliveries: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// replayDeadLetterAPIHandler queues a failed delivery again
+func replayDeadLetterAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid delivery ID")
+		return
+	}
+
+	delivery, err := outboundQueue.Replay(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if delivery == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("failed delivery %d not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+// updateReportAPIHandler replaces a posted report and updates its card in place
+func updateReportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	posted, ok := getPostedReport(w, r)
+	if !ok {
+		return
+	}
+	if posted.ActivityID == "" {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("report %s has not been delivered yet", posted.ID))
+		return
+	}
+
+	report, err := decodeReport(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if report.TenantID != posted.Report.TenantID {
+		writeJSONError(w, http.StatusBadRequest, "tenantId of a report cannot be changed")
+		return
+	}
+
+	posted.Report = report
+	posted.UpdatedAt = time.Now()
+	err = updateActivity(posted.ConversationID, posted.ActivityID, createPostedReportCard(posted, ""))
+	if err != nil {
+		log.Printf("Failed to update report %s: %v", posted.ID, err)
+		writeJSONError(w, sendFailureStatus(err), err.Error())
+		return
+	}
+
+	err = reportStore.Save(posted)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to save report: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReportResponse{
+		ReportID:       posted.ID,
+		ActivityID:     posted.ActivityID,
+		ConversationID: posted.ConversationID,
+	})
+}
+
+// deleteReportAPIHandler removes a posted report card from its channel
+func deleteReportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	posted, ok := getPostedReport(w, r)
+	if !ok {
+		return
+	}
+	if posted.ActivityID == "" {
+		writeJSONError(w, http.StatusConflict, fmt.Sprintf("report %s has not been delivered yet", posted.ID))
+		return
+	}
+
+	// Deleting the root report of a case also forgets its thread, so later posts do not reply to a deleted message
+	err := removeCaseActivity(posted.Report.TenantID, reportThreadID(posted.Report.CaseID), posted.ConversationID, posted.ActivityID)
+	if err != nil {
+		log.Printf("Failed to delete report %s: %v", posted.ID, err)
+		status := http.StatusInternalServerError
+		if errors.As(err, new(*SendError)) {
+			status = sendFailureStatus(err)
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	err = reportStore.Delete(posted.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to delete report: "+err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPostedReport loads the report named in the URL, writing an error response when it is missing
+func getPostedReport(w http.ResponseWriter, r *http.Request) (*PostedReport, bool) {
+	id := mux.Vars(r)["id"]
+	posted, err := reportStore.Get(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to load report: "+err.Error())
+		return nil, false
+	}
+	if posted == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("report %s not found", id))
+		return nil, false
+	}
+	return posted, true
+}
+
+// writeJSON writes value as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeJSONError writes an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,51 +14,111 @@ import (
 // reportHandler handles GET and POST requests for the report form
 func reportHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
+		integrations, err := ListIntegrations()
+		if err != nil {
+			http.Error(w, "Failed to list tenants: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		// Serve the report form
 		tmpl := template.Must(template.New("report").Parse(`
         <html>
             <body>
                 <h1>Submit Investigation Report</h1>
                 <form method="POST">
-                    <label>Time: <input type="text" name="time"></label><br>
+                    <label>Tenant: <select name="tenant">
+                        {{range .}}<option value="{{.Integration.Teams.TenantID}}">{{.Integration.Teams.TenantID}}</option>{{end}}
+                    </select></label><br>
+                    <label>Time: <input type="text" name="time" placeholder="2006-01-02 15:04"></label><br>
                     <label>Title: <input type="text" name="title"></label><br>
                     <label>Severity: <input type="text" name="severity"></label><br>
+                    <label>Case ID: <input type="text" name="case"></label><br>
                     <label>Description: <textarea name="description"></textarea></label><br>
                     <input type="submit" value="Send Report">
                 </form>
             </body>
         </html>
         `))
-		tmpl.Execute(w, nil)
+		tmpl.Execute(w, integrations)
 	} else if r.Method == "POST" {
 		// Process the submitted report
-		time := r.FormValue("time")
-		title := r.FormValue("title")
-		severity := r.FormValue("severity")
-		description := r.FormValue("description")
+		reportTime, err := parseFormTime(r.FormValue("time"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report := InvestigationReport{
+			TenantID:    r.FormValue("tenant"),
+			CaseID:      r.FormValue("case"),
+			Title:       r.FormValue("title"),
+			Time:        reportTime,
+			Severity:    Severity(r.FormValue("severity")),
+			Description: r.FormValue("description"),
+		}
 
-		// Create and send the report
-		card := createInvestigationCard(time, title, severity, description)
-		channelID := getChannelID()
-		if channelID == "" {
-			http.Error(w, "Channel ID not set", http.StatusInternalServerError)
+		// Look up the tenant's Reports channel
+		_, err = getReportsChannelID(report.TenantID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		err := sendBotMessage(channelID, "", card)
+		// Queue the report so it is delivered even if Teams is unreachable right now
+		_, err = queueReport(report)
 		if err != nil {
-			http.Error(w, "Failed to send message: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Failed to queue report: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		fmt.Fprintf(w, "Report sent successfully! <a href='/report'>Send another report</a>")
+		fmt.Fprintf(w, "Report queued for delivery! <a href='/report'>Send another report</a>")
+	}
+}
+
+// Time formats accepted by the report form
+var formTimeLayouts = []string{time.RFC3339, time.RFC1123, "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// parseFormTime reads the time field of the report form. An empty field means the submission
+// time; anything else must be in one of formTimeLayouts.
+func parseFormTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Now(), nil
+	}
+	for _, layout := range formTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q, use a format such as 2006-01-02 15:04", value)
+}
+
+// getReportsChannelID returns the Reports channel of a connected tenant
+func getReportsChannelID(tenantID string) (string, error) {
+	integration, err := FindIntegration(tenantID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up tenant: %w", err)
+	}
+	if integration == nil {
+		return "", fmt.Errorf("tenant %s is not connected", tenantID)
+	}
+	if integration.Integration.Teams.ChannelID == "" {
+		return "", fmt.Errorf("tenant %s has no Reports channel", tenantID)
 	}
+	return integration.Integration.Teams.ChannelID, nil
 }
 
 // startReportServer initializes and starts the report server
 func startReportServer() {
 	r := mux.NewRouter()
 	r.HandleFunc("/report", reportHandler)
+	r.HandleFunc("/api/v1/reports", requireAPIKey(createReportAPIHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/reports/{id}", requireAPIKey(updateReportAPIHandler)).Methods("PUT")
+	r.HandleFunc("/api/v1/reports/{id}", requireAPIKey(deleteReportAPIHandler)).Methods("DELETE")
+	r.HandleFunc("/api/v1/cases/{caseId}/followups", requireAPIKey(createFollowUpAPIHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/notifications", requireAPIKey(createNotificationAPIHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/deliveries/failed", requireAPIKey(listDeadLettersAPIHandler)).Methods("GET")
+	r.HandleFunc("/api/v1/deliveries/failed/{id}/replay", requireAPIKey(replayDeadLetterAPIHandler)).Methods("POST")
 
 	srv := &http.Server{
 		Handler:      r,
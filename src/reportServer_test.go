@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFormTime(t *testing.T) {
+	want := time.Date(2026, 3, 4, 15, 30, 0, 0, time.Local)
+
+	for _, value := range []string{"2026-03-04 15:30", "2026-03-04T15:30", " 2026-03-04 15:30:00 "} {
+		got, err := parseFormTime(value)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseFormTime(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+
+	if got, err := parseFormTime(""); err != nil || time.Since(got) > time.Minute {
+		t.Errorf("expected the submission time for an empty field, got %v, %v", got, err)
+	}
+
+	for _, value := range []string{"yesterday at noon", "04/03/2026 15:30"} {
+		if _, err := parseFormTime(value); err == nil {
+			t.Errorf("expected parseFormTime(%q) to fail", value)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	reportsBucket     = "reports"
+	caseThreadsBucket = "case_threads"
+)
+
+// Report that has been posted to a Reports channel
+type PostedReport struct {
+	ID             string              `json:"id"`
+	Report         InvestigationReport `json:"report"`
+	ConversationID string              `json:"conversationId"`
+	ActivityID     string              `json:"activityId"`
+	Triage         TriageState         `json:"triage,omitempty"`
+	Assignee       string              `json:"assignee,omitempty"`
+	AssigneeID     string              `json:"assigneeId,omitempty"`
+	TriageEvents   []TriageEvent       `json:"triageEvents,omitempty"`
+	PostedAt       time.Time           `json:"postedAt"`
+	UpdatedAt      time.Time           `json:"updatedAt"`
+}
+
+// Channel thread started by the first post of a case
+type CaseThread struct {
+	TenantID       string    `json:"tenantId"`
+	ThreadID       string    `json:"threadId"` // See reportThreadID and questionThreadID
+	ChannelID      string    `json:"channelId"`
+	RootActivityID string    `json:"rootActivityId"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// ConversationID addresses replies to the thread
+func (t CaseThread) ConversationID() string {
+	return t.ChannelID + ";messageid=" + t.RootActivityID
+}
+
+// ReportStore keeps track of posted reports so their cards can be changed later
+type ReportStore interface {
+	Save(report *PostedReport) error
+	Get(id string) (*PostedReport, error)
+	Update(id string, modify func(report *PostedReport) error) (*PostedReport, error)
+	Delete(id string) error
+	SaveCaseThread(thread *CaseThread) error
+	GetCaseThread(tenantID, threadID string) (*CaseThread, error)
+	DeleteCaseThread(tenantID, threadID string) error
+}
+
+// Global variables
+var (
+	reportStore ReportStore
+)
+
+// boltReportStore keeps posted reports in BoltDB keyed by report ID
+type boltReportStore struct {
+	db *bolt.DB
+}
+
+// initReportStore opens the report store
+func initReportStore() {
+	store, err := newBoltReportStore(db)
+	if err != nil {
+		log.Fatal("Error opening report store:", err)
+	}
+	reportStore = store
+}
+
+// newBoltReportStore creates the reports bucket if needed
+func newBoltReportStore(db *bolt.DB) (*boltReportStore, error) {
+	err := createBuckets(db, reportsBucket, caseThreadsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &boltReportStore{db: db}, nil
+}
+
+// Save creates or replaces a posted report
+func (s *boltReportStore) Save(report *PostedReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(reportsBucket)).Put([]byte(report.ID), data)
+	})
+}
+
+// Get returns the posted report with the given ID, or nil when there is none
+func (s *boltReportStore) Get(id string) (*PostedReport, error) {
+	var report *PostedReport
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(reportsBucket)).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		report = &PostedReport{}
+		return json.Unmarshal(data, report)
+	})
+	return report, err
+}
+
+// Update loads a report, applies modify and saves the result in one transaction, so concurrent
+// updates cannot overwrite each other. Returns nil when there is no such report.
+func (s *boltReportStore) Update(id string, modify func(report *PostedReport) error) (*PostedReport, error) {
+	var report *PostedReport
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(reportsBucket))
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		report = &PostedReport{}
+		if err := json.Unmarshal(data, report); err != nil {
+			return err
+		}
+		if err := modify(report); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(report)
+		if err != nil {
+			return fmt.Errorf("failed to marshal report: %w", err)
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Delete removes a posted report
+func (s *boltReportStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(reportsBucket)).Delete([]byte(id))
+	})
+}
+
+// SaveCaseThread records the root activity of a case's thread
+func (s *boltReportStore) SaveCaseThread(thread *CaseThread) error {
+	data, err := json.Marshal(thread)
+	if err != nil {
+		return fmt.Errorf("failed to marshal case thread: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(caseThreadsBucket)).Put(caseThreadKey(thread.TenantID, thread.ThreadID), data)
+	})
+}
+
+// GetCaseThread returns the thread of a case, or nil when the case has none yet
+func (s *boltReportStore) GetCaseThread(tenantID, threadID string) (*CaseThread, error) {
+	var thread *CaseThread
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(caseThreadsBucket)).Get(caseThreadKey(tenantID, threadID))
+		if data == nil {
+			return nil
+		}
+		thread = &CaseThread{}
+		return json.Unmarshal(data, thread)
+	})
+	return thread, err
+}
+
+// DeleteCaseThread forgets the thread of a case, so its next post starts a new one
+func (s *boltReportStore) DeleteCaseThread(tenantID, threadID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(caseThreadsBucket)).Delete(caseThreadKey(tenantID, threadID))
+	})
+}
+
+// caseThreadKey scopes thread IDs to their tenant
+func caseThreadKey(tenantID, threadID string) []byte {
+	return []byte(tenantID + "/" + threadID)
+}
+
+// reportThreadID returns the thread ID of a partner-supplied report case ID, or "" when there is no case.
+// Report and question threads use different prefixes so a partner case ID can never name a question thread.
+func reportThreadID(caseID string) string {
+	if caseID == "" {
+		return ""
+	}
+	return "report/" + caseID
+}
+
+// questionThreadID returns the thread ID of the user questions of a case
+func questionThreadID(caseNumber int) string {
+	return fmt.Sprintf("question/%d", caseNumber)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Global variables
+var (
+	// Shared Bot Connector client. Each call is also bounded by botRetryPolicy.Budget.
+	botHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+	// Sends run inline in API handlers, so every call including its retries must finish well
+	// within the report server's 15 second WriteTimeout, even when a handler makes two of them.
+	// Longer waits are left to the caller or the outbox.
+	botRetryPolicy = retryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Budget:      5 * time.Second,
+	}
+)
+
+// SendError describes a failed Bot Connector call and whether trying again may help
+type SendError struct {
+	StatusCode int
+	Retryable  bool
+	RetryAfter time.Duration
+	Attempts   int
+	Err        error
+}
+
+// Error includes the status code and number of attempts when known
+func (e *SendError) Error() string {
+	msg := e.Err.Error()
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("status %d: %s", e.StatusCode, msg)
+	}
+	if e.Attempts > 1 {
+		msg = fmt.Sprintf("%s (after %d attempts)", msg, e.Attempts)
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// isRetryable reports whether err is a send failure that may succeed later
+func isRetryable(err error) bool {
+	var sendErr *SendError
+	return errors.As(err, &sendErr) && sendErr.Retryable
+}
+
+// isRetryableStatus reports whether an HTTP status is a throttling or transient server error
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isIdempotentMethod reports whether sending a request twice has the same effect as sending it once
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isRetryableResponse reports whether a failed response may be retried. A non-idempotent request
+// such as a POST of a new activity is only retried when the server says it did not process it:
+// 429, or 503 with a Retry-After. Anything else might have been applied and would be duplicated.
+func isRetryableResponse(method string, statusCode int, retryAfter time.Duration) bool {
+	if isIdempotentMethod(method) {
+		return isRetryableStatus(statusCode)
+	}
+	return statusCode == http.StatusTooManyRequests || (statusCode == http.StatusServiceUnavailable && retryAfter > 0)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// Exponential backoff settings. Budget, when set, limits the total time of all attempts.
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Budget      time.Duration
+}
+
+// delay returns how long to wait before the given retry (1 for the first retry). It uses
+// exponential backoff with full jitter, but never waits less than the server asked for,
+// up to MaxDelay.
+func (p retryPolicy) delay(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > p.MaxDelay {
+		retryAfter = p.MaxDelay
+	}
+
+	backoff := p.BaseDelay << (retry - 1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+// do runs attempt until it succeeds, fails permanently, runs out of attempts or would run past
+// the budget. Each attempt gets a context that ends with the budget. When the server asks to
+// wait longer than MaxDelay the error is returned instead, leaving the retry to the caller,
+// such as the outbox, rather than blocking the goroutine.
+func (p retryPolicy) do(attempt func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	ctx := context.Background()
+	if p.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Budget)
+		defer cancel()
+	}
+
+	for i := 1; ; i++ {
+		body, err := attempt(ctx)
+		if err == nil {
+			return body, nil
+		}
+
+		var sendErr *SendError
+		if !errors.As(err, &sendErr) {
+			return nil, err
+		}
+		sendErr.Attempts = i
+		if !sendErr.Retryable || i >= p.MaxAttempts || sendErr.RetryAfter > p.MaxDelay {
+			return nil, sendErr
+		}
+
+		wait := p.delay(i, sendErr.RetryAfter)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return nil, sendErr
+		}
+		time.Sleep(wait)
+	}
+}
+
+// sendFailureStatus maps a failed send to the status returned to API callers: 503 when
+// retries ran out on a transient failure, 502 when Teams rejected the request
+func sendFailureStatus(err error) int {
+	if isRetryable(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
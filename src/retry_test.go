@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTestBotToken installs a bot token and send limiter so Bot Connector calls can run against a test server
+func useTestBotToken(t *testing.T) {
+	t.Helper()
+
+	botTokenMutex.Lock()
+	previous := currentBotToken
+	currentBotToken = &BotToken{Token: "test-token", ExpiresAt: time.Now().Add(time.Hour)}
+	botTokenMutex.Unlock()
+
+	previousLimiter := sendLimiter
+	sendLimiter = newSendLimiter()
+
+	t.Cleanup(func() {
+		botTokenMutex.Lock()
+		currentBotToken = previous
+		botTokenMutex.Unlock()
+		sendLimiter = previousLimiter
+	})
+}
+
+// useFastRetries shortens the Bot Connector retry policy for the duration of a test
+func useFastRetries(t *testing.T) {
+	t.Helper()
+
+	previous := botRetryPolicy
+	botRetryPolicy = retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	t.Cleanup(func() { botRetryPolicy = previous })
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for retry := 1; retry <= 10; retry++ {
+		for i := 0; i < 50; i++ {
+			delay := policy.delay(retry, 0)
+			if delay < 0 || delay > policy.MaxDelay {
+				t.Fatalf("retry %d: delay %v outside [0, %v]", retry, delay, policy.MaxDelay)
+			}
+		}
+	}
+
+	if delay := policy.delay(1, 500*time.Millisecond); delay < 500*time.Millisecond {
+		t.Errorf("expected at least the Retry-After delay, got %v", delay)
+	}
+	if delay := policy.delay(1, time.Hour); delay != policy.MaxDelay {
+		t.Errorf("expected Retry-After to be capped at %v, got %v", policy.MaxDelay, delay)
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	tests := []struct {
+		name         string
+		err          error
+		wantAttempts int
+	}{
+		{"retryable until attempts run out", &SendError{Retryable: true, Err: errors.New("busy")}, 3},
+		{"permanent failure", &SendError{Err: errors.New("bad request")}, 1},
+		{"plain error", errors.New("boom"), 1},
+		{"retry-after beyond max delay", &SendError{Retryable: true, RetryAfter: time.Hour, Err: errors.New("throttled")}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			_, err := policy.do(func(context.Context) ([]byte, error) {
+				attempts++
+				return nil, tt.err
+			})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", tt.wantAttempts, attempts)
+			}
+		})
+	}
+
+	attempts := 0
+	body, err := policy.do(func(context.Context) ([]byte, error) {
+		attempts++
+		if attempts < 2 {
+			return nil, &SendError{Retryable: true, Err: errors.New("busy")}
+		}
+		return []byte("ok"), nil
+	})
+	if err != nil || string(body) != "ok" || attempts != 2 {
+		t.Errorf("expected success on the second attempt, got %q, %v after %d attempts", body, err, attempts)
+	}
+}
+
+func TestRetryPolicyBudget(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 100, BaseDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond, Budget: 100 * time.Millisecond}
+
+	start := time.Now()
+	attempts := 0
+	_, err := policy.do(func(ctx context.Context) ([]byte, error) {
+		attempts++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected each attempt to have a deadline")
+		}
+		return nil, &SendError{Retryable: true, Err: errors.New("busy")}
+	})
+	if !isRetryable(err) {
+		t.Fatalf("expected the last retryable error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected retries to stop within the budget, took %v", elapsed)
+	}
+	if attempts < 2 || attempts >= 100 {
+		t.Errorf("expected a few attempts within the budget, got %d", attempts)
+	}
+}
+
+func TestIsRetryableResponse(t *testing.T) {
+	tests := []struct {
+		method     string
+		status     int
+		retryAfter time.Duration
+		want       bool
+	}{
+		{http.MethodPut, http.StatusInternalServerError, 0, true},
+		{http.MethodDelete, http.StatusGatewayTimeout, 0, true},
+		{http.MethodGet, http.StatusBadRequest, 0, false},
+		{http.MethodPost, http.StatusTooManyRequests, 0, true},
+		{http.MethodPost, http.StatusServiceUnavailable, time.Second, true},
+		{http.MethodPost, http.StatusServiceUnavailable, 0, false},
+		{http.MethodPost, http.StatusInternalServerError, 0, false},
+		{http.MethodPost, http.StatusGatewayTimeout, 0, false},
+	}
+
+	for _, tt := range tests {
+		if got := isRetryableResponse(tt.method, tt.status, tt.retryAfter); got != tt.want {
+			t.Errorf("isRetryableResponse(%s, %d, %v) = %v, want %v", tt.method, tt.status, tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("3"); got != 3*time.Second {
+		t.Errorf("expected 3s, got %v", got)
+	}
+	if got := parseRetryAfter(""); got != 0 {
+		t.Errorf("expected 0 for a missing header, got %v", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("expected 0 for an invalid header, got %v", got)
+	}
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(at); got <= 0 || got > time.Minute {
+		t.Errorf("expected up to a minute for an HTTP date, got %v", got)
+	}
+}
+
+func TestBotConnectorRequestDoesNotRepeatPosts(t *testing.T) {
+	useTestBotToken(t)
+	useFastRetries(t)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := botConnectorRequest(http.MethodPost, server.URL+"/v3/conversations/a/activities", map[string]string{"text": "hi"})
+	if err == nil {
+		t.Fatal("expected the POST to fail")
+	}
+	if isRetryable(err) {
+		t.Error("a POST that reached the server must not be reported as retryable")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 POST, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	_, err = botConnectorRequest(http.MethodPut, server.URL+"/v3/conversations/a/activities/1", map[string]string{"text": "hi"})
+	if err == nil {
+		t.Fatal("expected the PUT to fail")
+	}
+	if calls.Load() != int32(botRetryPolicy.MaxAttempts) {
+		t.Errorf("expected the PUT to be tried %d times, got %d", botRetryPolicy.MaxAttempts, calls.Load())
+	}
+}
+
+func TestBotConnectorRequestStopsAtBudget(t *testing.T) {
+	useTestBotToken(t)
+
+	previous := botRetryPolicy
+	botRetryPolicy = retryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Budget: 100 * time.Millisecond}
+	t.Cleanup(func() { botRetryPolicy = previous })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := botConnectorRequest(http.MethodGet, server.URL+"/v3/conversations/a/members/b", nil)
+	if err == nil {
+		t.Fatal("expected the slow request to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the request to give up at the budget, took %v", elapsed)
+	}
+}
+
+func TestBotConnectorRequestRetriesThrottledPosts(t *testing.T) {
+	useTestBotToken(t)
+	useFastRetries(t)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id":"1"}`))
+	}))
+	defer server.Close()
+
+	body, err := botConnectorRequest(http.MethodPost, server.URL+"/v3/conversations/a/activities", map[string]string{"text": "hi"})
+	if err != nil {
+		t.Fatalf("expected the throttled POST to succeed on retry, got %v", err)
+	}
+	if string(body) != `{"id":"1"}` || calls.Load() != 2 {
+		t.Errorf("unexpected result %q after %d calls", body, calls.Load())
+	}
+}
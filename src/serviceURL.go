@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultServiceURL = "https://smba.trafficmanager.net/amer/"
+)
+
+// Global variables
+var (
+	conversationServiceURLs = make(map[string]string)
+	channelServiceURLs      = make(map[string]string)
+	serviceURLMutex         sync.RWMutex
+)
+
+// rememberServiceURL records the serviceUrl of an inbound activity for its conversation and channel
+func rememberServiceURL(activity Activity) {
+	if activity.ServiceURL == "" {
+		return
+	}
+
+	serviceURLMutex.Lock()
+	defer serviceURLMutex.Unlock()
+
+	if activity.Conversation.ID != "" {
+		conversationServiceURLs[activity.Conversation.ID] = activity.ServiceURL
+	}
+	if activity.ChannelData.Channel.ID != "" {
+		channelServiceURLs[activity.ChannelData.Channel.ID] = activity.ServiceURL
+	}
+}
+
+// rememberConversationServiceURL records a serviceUrl for a conversation the bot has not heard from yet
+func rememberConversationServiceURL(conversationID, serviceURL string) {
+	if serviceURL == "" {
+		return
+	}
+
+	serviceURLMutex.Lock()
+	defer serviceURLMutex.Unlock()
+
+	if _, ok := conversationServiceURLs[conversationID]; !ok {
+		conversationServiceURLs[conversationID] = serviceURL
+	}
+}
+
+// getServiceURL returns the serviceUrl to use when sending to the given conversation
+func getServiceURL(conversationID string) string {
+	// Channel threads use "<channel ID>;messageid=<root ID>" as their conversation ID
+	channel := strings.SplitN(conversationID, ";", 2)[0]
+
+	serviceURLMutex.RLock()
+	serviceURL, ok := conversationServiceURLs[conversationID]
+	if !ok {
+		serviceURL, ok = channelServiceURLs[channel]
+	}
+	if !ok {
+		serviceURL, ok = conversationServiceURLs[channel]
+	}
+	serviceURLMutex.RUnlock()
+
+	if ok {
+		return serviceURL
+	}
+
+	// Fall back to the serviceUrl last seen for the tenant owning this channel
+	integration, err := FindIntegrationByChannel(channel)
+	if err != nil {
+		log.Printf("Failed to look up integration for %s: %v", channel, err)
+	} else if integration != nil && integration.Integration.Teams.ServiceURL != "" {
+		return integration.Integration.Teams.ServiceURL
+	}
+
+	return getDefaultServiceURL()
+}
+
+// getDefaultServiceURL returns the configured fallback serviceUrl
+func getDefaultServiceURL() string {
+	if serviceURL := os.Getenv("DEFAULT_SERVICE_URL"); serviceURL != "" {
+		return serviceURL
+	}
+	return defaultServiceURL
+}
+
+// conversationActivitiesURL builds the Bot Connector activities endpoint for a conversation
+func conversationActivitiesURL(conversationID string) string {
+	return strings.TrimSuffix(getServiceURL(conversationID), "/") + "/v3/conversations/" + conversationID + "/activities"
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -14,110 +12,414 @@ import (
 	"github.com/joho/godotenv"
 )
 
-// Main setup function
-func setupEnvironment(token string) (string, error) {
-	apps, err := listApps(token)
+const (
+	reportsChannelName = "Reports"
 
+	// Status of a provisioning step
+	setupStepDone     = "done"
+	setupStepExisting = "already done"
+	setupStepFailed   = "failed"
+	setupStepSkipped  = "skipped"
+	setupStepPending  = "waiting for admin approval"
+)
+
+// Outcome of a single provisioning step
+type setupStep struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// Outcome of setting up a tenant's environment
+type setupResult struct {
+	Message   string
+	TeamID    string
+	ChannelID string
+	Steps     []setupStep
+}
+
+// provisioner carries the state shared by the provisioning steps of one tenant
+type provisioner struct {
+	client     *GraphClient
+	tenantID   string
+	saved      Teams
+	result     *setupResult
+	appID      string
+	appVersion string
+
+	// Newer catalog version that an admin has not approved yet, which cannot be installed
+	pendingVersion string
+}
+
+// Provisioning steps in the order they run. Each step first checks whether its work
+// is already done, so a later login carries on from the step that failed.
+var setupSteps = []struct {
+	name string
+	run  func(p *provisioner) (status, detail string, err error)
+}{
+	{"Team", (*provisioner).ensureTeam},
+	{"Reports channel", (*provisioner).ensureChannel},
+	{"App catalog", (*provisioner).ensureCatalogApp},
+	{"App installation", (*provisioner).ensureAppInstalled},
+	{"Welcome message", (*provisioner).ensureWelcome},
+}
+
+// Main setup function. It reconciles the tenant's team, Reports channel, app and welcome
+// message with what should exist, saving progress on the integration after every step.
+// The result lists the status of each step, also when err is not nil.
+func setupEnvironment(tenantID, token string) (*setupResult, error) {
+	p := &provisioner{
+		client:   newTokenGraphClient(token),
+		tenantID: tenantID,
+		result:   &setupResult{},
+	}
+
+	// Load environment variables
+	err := godotenv.Load()
 	if err != nil {
-		return "", fmt.Errorf("failed to list apps: %v", err)
+		return p.result, fmt.Errorf("error loading .env file: %w", err)
 	}
 
-	for _, app := range apps {
-		if app.DisplayName == "Culminate Security" {
-			err := deleteApp(token, app.ID)
-			if err != nil {
-				fmt.Printf("Failed to delete app %s: %v\n", app.ID, err)
-			} else {
-				fmt.Printf("Deleted app %s\n", app.ID)
-			}
+	// Resume from the team and channel recorded by an earlier run
+	existing, err := FindIntegration(tenantID)
+	if err != nil {
+		return p.result, fmt.Errorf("failed to load integration: %w", err)
+	}
+	if existing != nil {
+		p.saved = *existing.Integration.Teams
+	}
+
+	var setupErr error
+	for _, step := range setupSteps {
+		if setupErr != nil {
+			p.result.Steps = append(p.result.Steps, setupStep{Name: step.name, Status: setupStepSkipped})
+			continue
+		}
+
+		status, detail, err := step.run(p)
+		if err != nil {
+			status, detail = setupStepFailed, err.Error()
+			setupErr = fmt.Errorf("%s: %w", strings.ToLower(step.name), err)
+		}
+		p.result.Steps = append(p.result.Steps, setupStep{Name: step.name, Status: status, Detail: detail})
+
+		err = SaveTenantIntegration(Teams{
+			TenantID:  tenantID,
+			TeamID:    p.result.TeamID,
+			ChannelID: p.result.ChannelID,
+		})
+		if err != nil {
+			log.Printf("Failed to save setup progress for tenant %s: %v", tenantID, err)
 		}
 	}
-	// Load environment variables
-	err = godotenv.Load()
 
-	if err != nil {
-		return "", fmt.Errorf("error loading .env file: %w", err)
+	p.result.Message = p.result.summary()
+	return p.result, setupErr
+}
+
+// summary lists every step with its status
+func (r *setupResult) summary() string {
+	var lines []string
+	for _, step := range r.Steps {
+		line := fmt.Sprintf("%s: %s", step.Name, step.Status)
+		if step.Detail != "" {
+			line += " (" + step.Detail + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ensureTeam finds the team recorded earlier or named TEAM_NAME, creating it when neither exists
+func (p *provisioner) ensureTeam() (string, string, error) {
+	if p.saved.TeamID != "" {
+		var team struct {
+			ID string `json:"id"`
+		}
+		err := p.client.Get(fmt.Sprintf("/teams/%s?$select=id", p.saved.TeamID), &team)
+		if err == nil {
+			p.result.TeamID = team.ID
+			return setupStepExisting, "Team ID: " + team.ID, nil
+		}
+		if !isGraphStatus(err, http.StatusNotFound) {
+			return "", "", fmt.Errorf("failed to look up team %s: %w", p.saved.TeamID, err)
+		}
+		log.Printf("Team %s of tenant %s no longer exists", p.saved.TeamID, p.tenantID)
 	}
 
-	// Check if team already exists
 	teamName := os.Getenv("TEAM_NAME")
-	exists, teamID, err := checkTeamExists(token, teamName)
+	exists, teamID, err := checkTeamExists(p.client, teamName)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check if team exists: %w", err)
+	}
+	if exists {
+		p.result.TeamID = teamID
+		return setupStepExisting, "Team ID: " + teamID, nil
+	}
 
+	teamID, err = createTeam(p.client)
 	if err != nil {
-		return "", fmt.Errorf("failed to check if team exists: %v", err)
+		return "", "", err
 	}
+	p.result.TeamID = teamID
+	return setupStepDone, "Team ID: " + teamID, nil
+}
 
-	if exists {
-		return fmt.Sprintf("Team '%s' already exists. Please use the existing team. Team ID: %s", teamName, teamID), nil
+// ensureChannel finds the Reports channel in the team, creating it when missing
+func (p *provisioner) ensureChannel() (string, string, error) {
+	channelID, err := findChannel(p.client, p.result.TeamID, reportsChannelName)
+	if err != nil {
+		return "", "", err
+	}
+	if channelID != "" {
+		p.result.ChannelID = channelID
+		return setupStepExisting, "Channel ID: " + channelID, nil
 	}
 
-	// Create new team
-	teamID, err = createTeam(token)
+	channelID, err = createChannel(p.client, p.result.TeamID)
+	if err != nil {
+		return "", "", err
+	}
+	p.result.ChannelID = channelID
+	return setupStepDone, "Channel ID: " + channelID, nil
+}
 
+// ensureCatalogApp publishes the app in APP_ZIP to the tenant's app catalog, updating the
+// existing catalog entry in place when the package has a newer version
+func (p *provisioner) ensureCatalogApp() (string, string, error) {
+	appZip := os.Getenv("APP_ZIP")
+	manifest, err := readAppManifest(appZip)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	app, err := findCatalogApp(p.client, manifest)
+	if err != nil {
+		return "", "", err
+	}
+
+	if app == nil {
+		appID, err := uploadAppToCatalog(p.client, appZip)
+		if err != nil {
+			return "", "", err
+		}
+		p.appID, p.appVersion = appID, manifest.Version
+		return setupStepDone, fmt.Sprintf("published version %s, App ID: %s", manifest.Version, appID), nil
 	}
 
-	// Create channel in the new team
-	channelID, err := createChannel(token, teamID)
+	p.appID = app.ID
+	p.appVersion, p.pendingVersion = app.versions()
+
+	// A pending version counts as current so the same package is not submitted again
+	current := p.appVersion
+	if p.pendingVersion != "" {
+		current = p.pendingVersion
+	}
+	if compareVersions(manifest.Version, current) <= 0 {
+		if p.pendingVersion != "" {
+			return setupStepExisting, "version " + p.pendingVersion + " awaiting admin approval", nil
+		}
+		return setupStepExisting, "version " + current, nil
+	}
 
+	err = updateCatalogApp(p.client, app.ID, appZip)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	p.appVersion, p.pendingVersion = manifest.Version, ""
+	return setupStepDone, fmt.Sprintf("updated from version %s to %s", current, manifest.Version), nil
+}
+
+// ensureAppInstalled installs the catalog app in the team, or upgrades an installation of an older version
+func (p *provisioner) ensureAppInstalled() (string, string, error) {
+	installation, err := findInstalledApp(p.client, p.result.TeamID, p.appID)
+	if err != nil {
+		return "", "", err
 	}
 
-	// Update environment variables
+	if installation == nil {
+		if p.appVersion == "" {
+			return setupStepPending, "version " + p.pendingVersion, nil
+		}
+		err = installCustomApp(p.client, p.result.TeamID, p.appID)
+		if err != nil {
+			return "", "", err
+		}
+		return setupStepDone, "version " + p.appVersion, nil
+	}
 
-	envVars := map[string]string{
-		"TEAM_ID":    teamID,
-		"CHANNEL_ID": channelID,
+	// Only a published version can be installed, so a pending one is reported rather than upgraded to
+	installed := installation.TeamsAppDefinition.Version
+	if compareVersions(installed, p.appVersion) >= 0 {
+		if p.pendingVersion != "" && compareVersions(installed, p.pendingVersion) < 0 {
+			return setupStepPending, fmt.Sprintf("version %s installed, version %s pending", installed, p.pendingVersion), nil
+		}
+		return setupStepExisting, "version " + installed, nil
 	}
 
-	err = updateEnvFile(envVars)
+	err = upgradeInstalledApp(p.client, p.result.TeamID, installation.ID)
+	if err != nil {
+		return "", "", err
+	}
+	return setupStepDone, fmt.Sprintf("upgraded from version %s to %s", installed, p.appVersion), nil
+}
 
+// ensureWelcome posts the welcome message and card to the Reports channel once per team
+func (p *provisioner) ensureWelcome() (string, string, error) {
+	key := teamWelcomeKey(p.result.TeamID)
+	contact, err := contactStore.Get(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to update .env file: %v", err)
+		return "", "", fmt.Errorf("failed to look up welcome: %w", err)
+	}
+	if contact != nil {
+		return setupStepExisting, "", nil
 	}
 
-	updateChannelID(channelID)
+	// Send welcome message and sample report
+	err = sendWelcomeMessage(p.result.ChannelID)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to send welcome message: %w", err)
+	}
 
-	// Reload updated environment variables
-	err = godotenv.Load()
+	err = sendWelcomeCardAsBot(p.result.ChannelID)
+	if err != nil {
+		log.Printf("Failed to send welcome card: %v", err)
+	}
 
+	// Shares the record used when the bot is added to the team, so the team is only greeted once
+	_, err = contactStore.MarkWelcomed(&Contact{
+		Key:            key,
+		Name:           "Culminate Security",
+		ConversationID: p.result.ChannelID,
+		TenantID:       p.tenantID,
+		WelcomedAt:     time.Now(),
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to reload .env file: %v", err)
+		log.Printf("Failed to record welcome of team %s: %v", p.result.TeamID, err)
 	}
+	return setupStepDone, "", nil
+}
 
-	// Upload and install custom app
-	appID, err := uploadAppToCatalog(token, os.Getenv("APP_ZIP"))
+// App published to the tenant's app catalog
+type catalogApp struct {
+	ID             string          `json:"id"`
+	ExternalID     string          `json:"externalId"`
+	DisplayName    string          `json:"displayName"`
+	AppDefinitions []appDefinition `json:"appDefinitions"`
+}
 
+// Version of a catalog app
+type appDefinition struct {
+	ID              string `json:"id"`
+	Version         string `json:"version"`
+	PublishingState string `json:"publishingState"`
+}
+
+// versions returns the highest published version of the app and the highest version awaiting
+// admin approval when that is newer, or "" for either when there is none
+func (a *catalogApp) versions() (published, pending string) {
+	for _, definition := range a.AppDefinitions {
+		switch definition.PublishingState {
+		case "", "published":
+			if published == "" || compareVersions(definition.Version, published) > 0 {
+				published = definition.Version
+			}
+		case "submitted":
+			if pending == "" || compareVersions(definition.Version, pending) > 0 {
+				pending = definition.Version
+			}
+		}
+	}
+	if pending != "" && published != "" && compareVersions(pending, published) <= 0 {
+		pending = ""
+	}
+	return published, pending
+}
+
+// findCatalogApp returns the catalog app published from the manifest, or nil when it was never
+// published. Apps are matched on externalId, falling back to the organization's apps with the
+// manifest's ID or short name for entries whose externalId does not match exactly.
+func findCatalogApp(client *GraphClient, manifest *appManifest) (*catalogApp, error) {
+	query := url.Values{}
+	query.Set("$filter", fmt.Sprintf("externalId eq '%s'", strings.ReplaceAll(manifest.ID, "'", "''")))
+	query.Set("$expand", "appDefinitions")
+
+	var apps []catalogApp
+	err := client.GetAll("/appCatalogs/teamsApps?"+query.Encode(), &apps)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload app package: %v", err)
+		return nil, fmt.Errorf("failed to look up catalog app: %w", err)
+	}
+	if len(apps) > 0 {
+		return &apps[0], nil
 	}
 
-	err = installCustomApp(token, teamID, appID)
+	query = url.Values{}
+	query.Set("$filter", "distributionMethod eq 'organization'")
+	query.Set("$expand", "appDefinitions")
 
+	err = client.GetAll("/appCatalogs/teamsApps?"+query.Encode(), &apps)
 	if err != nil {
-		return "", fmt.Errorf("failed to install custom app: %v", err)
+		return nil, fmt.Errorf("failed to list catalog apps: %w", err)
+	}
+	for _, app := range apps {
+		if strings.EqualFold(app.ExternalID, manifest.ID) {
+			return &app, nil
+		}
+	}
+	for _, app := range apps {
+		if manifest.Name.Short != "" && app.DisplayName == manifest.Name.Short {
+			return &app, nil
+		}
 	}
+	return nil, nil
+}
 
-	// Send welcome message and sample report
-	err = sendWelcomeMessage(channelID)
+// Installation of an app in a team
+type installedApp struct {
+	ID                 string `json:"id"`
+	TeamsAppDefinition struct {
+		TeamsAppID string `json:"teamsAppId"`
+		Version    string `json:"version"`
+	} `json:"teamsAppDefinition"`
+}
 
+// findInstalledApp returns the team's installation of a catalog app, or nil when it is not installed
+func findInstalledApp(client *GraphClient, teamID, appID string) (*installedApp, error) {
+	var installations []installedApp
+	err := client.GetAll(fmt.Sprintf("/teams/%s/installedApps?$expand=teamsAppDefinition", teamID), &installations)
 	if err != nil {
-		log.Printf("Failed to send bot message: %v", err)
+		return nil, fmt.Errorf("failed to list installed apps: %w", err)
 	}
 
-	err = sendWelcomeCardAsBot(channelID)
+	for _, installation := range installations {
+		if installation.TeamsAppDefinition.TeamsAppID == appID {
+			return &installation, nil
+		}
+	}
+	return nil, nil
+}
 
+// findChannel returns the ID of the team's channel with the given name, or "" when there is none
+func findChannel(client *GraphClient, teamID, name string) (string, error) {
+	var channels []struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"displayName"`
+	}
+	err := client.GetAll(fmt.Sprintf("/teams/%s/channels", teamID), &channels)
 	if err != nil {
-		log.Printf("Failed to send welcome card: %v", err)
+		return "", fmt.Errorf("failed to list channels: %w", err)
 	}
 
-	return fmt.Sprintf("New team created successfully. Team ID: %s, Channel ID: %s", teamID, channelID), nil
+	for _, channel := range channels {
+		if channel.DisplayName == name {
+			return channel.ID, nil
+		}
+	}
+	return "", nil
 }
 
 // Create the Culminate Security team
-func createTeam(token string) (string, error) {
+func createTeam(client *GraphClient) (string, error) {
 	// Load environment variables from .env file
 	err := godotenv.Load()
 	if err != nil {
@@ -142,112 +444,66 @@ func createTeam(token string) (string, error) {
 		Picture:     teamPicture,
 	}
 
-	// Marshal the team struct into JSON
-	jsonData, err := json.Marshal(team)
-	if err != nil {
-		return "", err
-	}
-
-	// Create a POST request to create the team
-	req, err := http.NewRequest("POST", graphAPIBaseURL+"/teams", bytes.NewBuffer(jsonData))
+	// Send the request to create the team
+	resp, err := client.Post("/teams", team, nil)
 	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send the HTTP request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, _ := io.ReadAll(resp.Body)
-
-	// Handle response statuses
-	if resp.StatusCode == 409 {
-		return "", fmt.Errorf("Team already exists")
-	}
-
-	if resp.StatusCode != 201 && resp.StatusCode != 202 {
-		return "", fmt.Errorf("failed to create team: %s", string(body))
+		if isGraphStatus(err, http.StatusConflict) {
+			return "", fmt.Errorf("Team already exists")
+		}
+		return "", fmt.Errorf("failed to create team: %w", err)
 	}
 
 	// For asynchronous creation (202 status), we need to check the operation status
-	if resp.StatusCode == 202 {
+	if resp.StatusCode == http.StatusAccepted {
 		location := resp.Header.Get("Location")
-		return waitForTeamCreation(token, location)
+		return waitForTeamCreation(client, location)
 	}
 
-	// Unmarshal the response body into a map to extract team ID
-	var result map[string]interface{}
-	err = json.Unmarshal(body, &result)
+	// Extract and return the team ID
+	var result struct {
+		ID string `json:"id"`
+	}
+	err = decodeGraphBody(resp, &result)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse response: %s", string(body))
+		return "", err
 	}
-
-	// Extract and return the team ID
-	return result["id"].(string), nil
+	if result.ID == "" {
+		return "", fmt.Errorf("invalid response format")
+	}
+	return result.ID, nil
 }
 
 // waitForTeamCreation polls the provided location URL to check the status of team creation
 // Retry up to 30 times with a 2-second interval between each attempt
-func waitForTeamCreation(token, location string) (string, error) {
+func waitForTeamCreation(client *GraphClient, location string) (string, error) {
 	for i := 0; i < 30; i++ { // Try up to 30 times
 		time.Sleep(2 * time.Second) // Wait 2 seconds between each attempt
 
-		// Ensure the location URL is absolute
-		if !strings.HasPrefix(location, "https://") {
-			location = graphAPIBaseURL + location
-		}
-
-		// Create a GET request to check the status
-		req, err := http.NewRequest("GET", location, nil)
-		if err != nil {
-			return "", fmt.Errorf("error creating request: %v", err)
+		// Check the status of the operation; relative locations resolve against the client's base URL
+		var result struct {
+			Status           string      `json:"status"`
+			TargetResourceID string      `json:"targetResourceId"`
+			Error            interface{} `json:"error"`
 		}
-		req.Header.Set("Authorization", "Bearer "+token)
-
-		// Send the request
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		err := client.Get(location, &result)
 		if err != nil {
-			return "", fmt.Errorf("error making request: %v", err)
-		}
-		defer resp.Body.Close()
-
-		// Decode the response
-		var result map[string]interface{}
-		err = json.NewDecoder(resp.Body).Decode(&result)
-		if err != nil {
-			return "", fmt.Errorf("error decoding response: %v", err)
-		}
-
-		// Check the status of team creation
-		status, ok := result["status"].(string)
-		if !ok {
-			return "", fmt.Errorf("invalid status in response")
+			return "", fmt.Errorf("error checking team creation: %w", err)
 		}
 
-		switch status {
+		switch result.Status {
 		case "succeeded":
 			// If succeeded, return the team ID
-			targetResourceId, ok := result["targetResourceId"].(string)
-			if !ok {
+			if result.TargetResourceID == "" {
 				return "", fmt.Errorf("invalid targetResourceId in response")
 			}
-			return targetResourceId, nil
+			return result.TargetResourceID, nil
 		case "failed":
 			// If failed, return an error
-			return "", fmt.Errorf("team creation failed: %v", result["error"])
+			return "", fmt.Errorf("team creation failed: %v", result.Error)
 		case "inProgress", "notStarted":
 			// If still in progress, continue waiting
 		default:
-			return "", fmt.Errorf("unknown status: %s", status)
+			return "", fmt.Errorf("unknown status: %s", result.Status)
 		}
 	}
 
@@ -256,137 +512,91 @@ func waitForTeamCreation(token, location string) (string, error) {
 }
 
 // Creates a new channel named "Reports"
-func createChannel(token, teamID string) (string, error) {
+func createChannel(client *GraphClient, teamID string) (string, error) {
 	// Define the channel properties
 	channel := Channel{
-		DisplayName: "Reports",
+		DisplayName: reportsChannelName,
 		Description: "Channel to receive Culminate Security Reports",
 	}
 
-	// Marshal the channel data to JSON
-	jsonData, err := json.Marshal(channel)
-	if err != nil {
-		return "", err
+	// Send the request to create the channel and read its ID
+	var result struct {
+		ID string `json:"id"`
 	}
-
-	// Create a POST request to create the channel
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/teams/%s/channels", graphAPIBaseURL, teamID), bytes.NewBuffer(jsonData))
+	_, err := client.Post(fmt.Sprintf("/teams/%s/channels", teamID), channel, &result)
 	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	// Check if the channel was created successfully
-	if resp.StatusCode != 201 {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to create channel: %s", string(body))
+		return "", fmt.Errorf("failed to create channel: %w", err)
 	}
 
-	// Decode the response to get the channel ID
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	channelID := result["id"].(string)
-
-	return channelID, nil
+	return result.ID, nil
 }
 
 // installCustomApp installs a custom app in the specified team
-func installCustomApp(token, teamID, appID string) error {
-	url := fmt.Sprintf("%s/teams/%s/installedApps", graphAPIBaseURL, teamID)
-
+func installCustomApp(client *GraphClient, teamID, appID string) error {
 	// Prepare the payload for installing the app
 	payload := map[string]string{
-		"teamsApp@odata.bind": fmt.Sprintf("%s/appCatalogs/teamsApps/%s", graphAPIBaseURL, appID),
-	}
-
-	// Marshal the payload to JSON
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON payload: %w", err)
+		"teamsApp@odata.bind": fmt.Sprintf("%s/appCatalogs/teamsApps/%s", client.baseURL, appID),
 	}
 
-	// Create a POST request to install the app
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	_, err := client.Post(fmt.Sprintf("/teams/%s/installedApps", teamID), payload, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to install custom app: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// updateCatalogApp publishes a new version of an existing catalog app from an app package
+func updateCatalogApp(client *GraphClient, appID, appZipPath string) error {
+	// Read the app package file
+	appZip, err := os.ReadFile(appZipPath)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to open app package file: %w", err)
 	}
-	defer resp.Body.Close()
 
-	// Check if the app was installed successfully
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to install custom app: %s", string(body))
+	_, err = client.Do("POST", fmt.Sprintf("/appCatalogs/teamsApps/%s/appDefinitions", appID), "application/zip", appZip)
+	if err != nil {
+		return fmt.Errorf("failed to update app package: %w", err)
 	}
 
 	return nil
 }
 
-// uploadAppToCatalog uploads a custom app package to the Teams app catalog
-func uploadAppToCatalog(token string, appZipPath string) (string, error) {
-	// Open the app package file
-	appZip, err := os.Open(appZipPath)
+// upgradeInstalledApp upgrades a team's installation of an app to the latest catalog version
+func upgradeInstalledApp(client *GraphClient, teamID, installationID string) error {
+	_, err := client.Do("POST", fmt.Sprintf("/teams/%s/installedApps/%s/upgrade", teamID, installationID), "", nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to open app package file: %w", err)
+		return fmt.Errorf("failed to upgrade custom app: %w", err)
 	}
-	defer appZip.Close()
 
-	url := fmt.Sprintf("%s/appCatalogs/teamsApps", graphAPIBaseURL)
+	return nil
+}
 
-	// Create a POST request to upload the app package
-	req, err := http.NewRequest("POST", url, appZip)
+// uploadAppToCatalog uploads a custom app package to the Teams app catalog
+func uploadAppToCatalog(client *GraphClient, appZipPath string) (string, error) {
+	// Read the app package file
+	appZip, err := os.ReadFile(appZipPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return "", fmt.Errorf("failed to open app package file: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/zip")
-
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// Upload the app package
+	resp, err := client.Do("POST", "/appCatalogs/teamsApps", "application/zip", appZip)
 	if err != nil {
 		return "", fmt.Errorf("failed to upload app package: %w", err)
 	}
-	defer resp.Body.Close()
-
-	// Check if the app was uploaded successfully
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to upload app package: %s", string(body))
-	}
 
 	// Decode the response to get the app ID
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	var result struct {
+		ID string `json:"id"`
+	}
+	err = decodeGraphBody(resp, &result)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return "", err
 	}
-
-	appID, ok := result["id"].(string)
-	if !ok {
+	if result.ID == "" {
 		return "", fmt.Errorf("invalid response format")
 	}
 
-	return appID, nil
+	return result.ID, nil
 }
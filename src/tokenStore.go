@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultTokenStoreFile = "tokens.enc"
+)
+
+// TokenStore persists OAuth tokens per tenant and user
+type TokenStore interface {
+	Save(key string, token *oauth2.Token) error
+	Load(key string) (*oauth2.Token, error)
+	Delete(key string) error
+}
+
+// fileTokenStore keeps all tokens in a single AES-GCM encrypted file
+type fileTokenStore struct {
+	path string
+	aead cipher.AEAD
+	mu   sync.Mutex
+}
+
+// initTokenStore opens the encrypted token store with the key in TOKEN_STORE_KEY
+func initTokenStore() {
+	path := os.Getenv("TOKEN_STORE_FILE")
+	if path == "" {
+		path = defaultTokenStoreFile
+	}
+
+	// Required rather than generated, so the key is never written into .env and every
+	// instance can read the same store
+	encodedKey := os.Getenv("TOKEN_STORE_KEY")
+	if encodedKey == "" {
+		log.Fatal("TOKEN_STORE_KEY is not set; set it to a 32 byte random key in URL-safe base64")
+	}
+
+	key, err := base64.URLEncoding.DecodeString(encodedKey)
+	if err != nil {
+		log.Fatal("Error decoding TOKEN_STORE_KEY:", err)
+	}
+
+	tokenStore, err = newFileTokenStore(path, key)
+	if err != nil {
+		log.Fatal("Error opening token store:", err)
+	}
+}
+
+// newFileTokenStore creates a token store at path encrypted with a 32 byte key
+func newFileTokenStore(path string, key []byte) (*fileTokenStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token store key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return &fileTokenStore{path: path, aead: aead}, nil
+}
+
+// Save stores the full token under key
+func (s *fileTokenStore) Save(key string, token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+	tokens[key] = token
+	return s.write(tokens)
+}
+
+// Load returns the token stored under key
+func (s *fileTokenStore) Load(key string) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := tokens[key]
+	if !ok {
+		return nil, fmt.Errorf("no token stored for %s", key)
+	}
+	return token, nil
+}
+
+// Delete removes the token stored under key
+func (s *fileTokenStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+	delete(tokens, key)
+	return s.write(tokens)
+}
+
+// read decrypts the token file, returning an empty set when it does not exist yet
+func (s *fileTokenStore) read() (map[string]*oauth2.Token, error) {
+	tokens := make(map[string]*oauth2.Token)
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tokens, nil
+		}
+		return nil, fmt.Errorf("failed to read token store: %w", err)
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("token store is corrupted")
+	}
+	plaintext, err := s.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token store: %w", err)
+	}
+
+	err = json.Unmarshal(plaintext, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token store: %w", err)
+	}
+	return tokens, nil
+}
+
+// write encrypts the tokens with a fresh nonce and replaces the token file
+func (s *fileTokenStore) write(tokens map[string]*oauth2.Token) error {
+	plaintext, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tokens: %w", err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	data := s.aead.Seal(nonce, nonce, plaintext, nil)
+
+	// Write to a temporary file first so a crash never leaves a partial store
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write token store: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// storingTokenSource saves refreshed tokens back to the token store
+type storingTokenSource struct {
+	key  string
+	base oauth2.TokenSource
+	mu   sync.Mutex
+	last string
+}
+
+// Token returns a valid token, persisting it whenever it was refreshed
+func (s *storingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.last {
+		if err := tokenStore.Save(s.key, token); err != nil {
+			log.Printf("Failed to save refreshed token for %s: %v", s.key, err)
+		}
+		s.last = token.AccessToken
+	}
+	return token, nil
+}
+
+// getTokenSource returns a token source for the stored token that refreshes itself as needed
+func getTokenSource(ctx context.Context, key string) (oauth2.TokenSource, error) {
+	token, err := tokenStore.Load(key)
+	if err != nil {
+		return nil, err
+	}
+	return &storingTokenSource{
+		key:  key,
+		base: oauthConfig.TokenSource(ctx, token),
+		last: token.AccessToken,
+	}, nil
+}
+
+// getAccessToken returns a valid access token for the stored token, refreshing it if needed
+func getAccessToken(key string) (string, error) {
+	source, err := getTokenSource(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	token, err := source.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh token: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+// tokenKey builds the token store key for a tenant and user
+func tokenKey(tenantID, userID string) string {
+	return tenantID + "/" + userID
+}
+
+// tokenIdentity reads the tenant and user object IDs from the ID token returned with an OAuth token
+func tokenIdentity(token *oauth2.Token) (string, string, error) {
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", "", fmt.Errorf("token response has no id_token")
+	}
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("malformed id_token")
+	}
+
+	// The ID token comes straight from the token endpoint over TLS, so its claims are trusted
+	var claims struct {
+		TenantID string `json:"tid"`
+		ObjectID string `json:"oid"`
+	}
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return "", "", fmt.Errorf("invalid id_token claims: %w", err)
+	}
+	if claims.TenantID == "" || claims.ObjectID == "" {
+		return "", "", fmt.Errorf("id_token is missing tid or oid")
+	}
+
+	return claims.TenantID, claims.ObjectID, nil
+}
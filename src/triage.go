@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Triage state of a posted report
+type TriageState string
+
+const (
+	TriageStateNew           TriageState = "New"
+	TriageStateAcknowledged  TriageState = "Acknowledged"
+	TriageStateEscalated     TriageState = "Escalated"
+	TriageStateFalsePositive TriageState = "False Positive"
+)
+
+// Triage verbs sent by the buttons on an investigation card
+const (
+	triageVerbAcknowledge   = "acknowledge"
+	triageVerbEscalate      = "escalate"
+	triageVerbFalsePositive = "falsePositive"
+	triageVerbAssignToMe    = "assignToMe"
+)
+
+// Triage action taken on a report by an analyst
+type TriageEvent struct {
+	Verb string    `json:"verb"`
+	By   string    `json:"by"`
+	ByID string    `json:"byId"`
+	At   time.Time `json:"at"`
+}
+
+// Buttons shown on investigation cards, in display order
+var triageButtons = []struct {
+	title string
+	verb  string
+}{
+	{"Acknowledge", triageVerbAcknowledge},
+	{"Escalate", triageVerbEscalate},
+	{"Mark False Positive", triageVerbFalsePositive},
+	{"Assign to me", triageVerbAssignToMe},
+}
+
+// applyTriage records a triage action on the report and moves it to its new state
+func applyTriage(posted *PostedReport, verb string, by User) error {
+	switch verb {
+	case triageVerbAcknowledge:
+		posted.Triage = TriageStateAcknowledged
+	case triageVerbEscalate:
+		posted.Triage = TriageStateEscalated
+	case triageVerbFalsePositive:
+		posted.Triage = TriageStateFalsePositive
+	case triageVerbAssignToMe:
+		posted.Assignee = by.Name
+		posted.AssigneeID = by.ID
+	default:
+		return fmt.Errorf("unknown triage action: %s", verb)
+	}
+
+	posted.TriageEvents = append(posted.TriageEvents, TriageEvent{
+		Verb: verb,
+		By:   by.Name,
+		ByID: by.ID,
+		At:   time.Now(),
+	})
+	posted.UpdatedAt = time.Now()
+	return nil
+}
+
+// JSON format for a posted report, including its triage state and buttons. When viewerID is
+// set the card is the personal view of that user, otherwise it is the view shared by everyone.
+func createPostedReportCard(posted *PostedReport, viewerID string) map[string]interface{} {
+	card := createReportCard(posted.Report)
+	content := cardContent(card)
+	body := content["body"].([]map[string]interface{})
+
+	// Universal Actions need Adaptive Cards 1.4
+	content["version"] = "1.4"
+
+	state := posted.Triage
+	if state == "" {
+		state = TriageStateNew
+	}
+	text := fmt.Sprintf("Triage: %s", state)
+	if posted.AssigneeID != "" && posted.AssigneeID == viewerID {
+		text += " | Assigned to you"
+	} else if posted.Assignee != "" {
+		text += fmt.Sprintf(" | Assigned to %s", posted.Assignee)
+	}
+	if len(posted.TriageEvents) > 0 {
+		last := posted.TriageEvents[len(posted.TriageEvents)-1]
+		text += fmt.Sprintf("\n\nLast action by %s at %s", last.By, last.At.Format(time.RFC1123))
+	}
+	content["body"] = append(body, map[string]interface{}{
+		"type":      "TextBlock",
+		"text":      text,
+		"separator": true,
+		"wrap":      true,
+	})
+
+	// Action.Execute for clients that support Universal Actions, Action.Submit for the rest
+	actions, _ := content["actions"].([]map[string]interface{})
+	for _, button := range triageButtons {
+		if button.verb == triageVerbAssignToMe && viewerID != "" && posted.AssigneeID == viewerID {
+			continue
+		}
+		actions = append(actions, map[string]interface{}{
+			"type":  "Action.Execute",
+			"title": button.title,
+			"verb":  button.verb,
+			"data": map[string]interface{}{
+				"reportId": posted.ID,
+			},
+			"fallback": map[string]interface{}{
+				"type":  "Action.Submit",
+				"title": button.title,
+				"data": map[string]interface{}{
+					"cardAction": "triage",
+					"verb":       button.verb,
+					"reportId":   posted.ID,
+				},
+			},
+		})
+	}
+	content["actions"] = actions
+
+	// Refresh the card automatically for everyone who has worked on the report
+	content["refresh"] = map[string]interface{}{
+		"action": map[string]interface{}{
+			"type":  "Action.Execute",
+			"title": "Refresh",
+			"verb":  cardVerbRefresh,
+			"data": map[string]interface{}{
+				"reportId": posted.ID,
+			},
+		},
+		"userIds": triageUserIDs(posted),
+	}
+
+	return card
+}
+
+// triageUserIDs lists the users that have triaged or been assigned a report
+func triageUserIDs(posted *PostedReport) []string {
+	seen := make(map[string]bool)
+	userIDs := []string{}
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	add(posted.AssigneeID)
+	for _, event := range posted.TriageEvents {
+		add(event.ByID)
+	}
+	return userIDs
+}
+
+// handleTriageAction applies a triage button pressed on a card without Universal Actions support
+func handleTriageAction(activity Activity) {
+	data, err := json.Marshal(map[string]string{"reportId": activity.Value.ReportID})
+	if err != nil {
+		log.Printf("Failed to marshal triage data: %v", err)
+		return
+	}
+
+	_, err = executeTriage(activity, CardAction{Type: "Action.Submit", Verb: activity.Value.Verb, Data: data})
+	if err != nil {
+		log.Printf("Failed to triage report %s: %v", activity.Value.ReportID, err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const (
+	cardVerbRefresh = "refreshCard"
+)
+
+// Action.Execute payload of an adaptiveCard/action invoke activity
+type CardAction struct {
+	Type string          `json:"type"`
+	Verb string          `json:"verb"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Body of the HTTP response to an invoke activity
+type InvokeResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Type       string      `json:"type"`
+	Value      interface{} `json:"value"`
+}
+
+// Handles an Action.Execute verb and returns the card to show the user who acted
+type cardVerbHandler func(activity Activity, action CardAction) (map[string]interface{}, error)
+
+// Handlers for each Action.Execute verb
+var cardVerbHandlers = map[string]cardVerbHandler{
+	cardVerbRefresh:         refreshReportCard,
+	triageVerbAcknowledge:   executeTriage,
+	triageVerbEscalate:      executeTriage,
+	triageVerbFalsePositive: executeTriage,
+	triageVerbAssignToMe:    executeTriage,
+}
+
+// handleAdaptiveCardAction routes an Action.Execute invoke to the handler of its verb
+func handleAdaptiveCardAction(activity Activity) InvokeResponse {
+	action := activity.Value.Action
+	if action == nil || action.Type != "Action.Execute" {
+		return invokeError(http.StatusBadRequest, "BadRequest", "expected an Action.Execute action")
+	}
+
+	handler, ok := cardVerbHandlers[action.Verb]
+	if !ok {
+		return invokeError(http.StatusBadRequest, "NotSupported", fmt.Sprintf("verb %s is not supported", action.Verb))
+	}
+
+	card, err := handler(activity, *action)
+	if errors.Is(err, errActionForbidden) {
+		log.Printf("Rejected card action %s from %s: %v", action.Verb, activity.From.Name, err)
+		return invokeError(http.StatusForbidden, "Forbidden", err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to handle card action %s: %v", action.Verb, err)
+		return invokeError(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	return InvokeResponse{
+		StatusCode: http.StatusOK,
+		Type:       "application/vnd.microsoft.card.adaptive",
+		Value:      cardContent(card),
+	}
+}
+
+// invokeError builds the invoke response for a failed card action
+func invokeError(status int, code, message string) InvokeResponse {
+	return InvokeResponse{
+		StatusCode: status,
+		Type:       "application/vnd.microsoft.error",
+		Value: map[string]string{
+			"code":    code,
+			"message": message,
+		},
+	}
+}
+
+// Returned by card actions on reports that belong to another tenant
+var errActionForbidden = errors.New("report belongs to another tenant")
+
+// actionReportID reads the report ID from a card action's data
+func actionReportID(action CardAction) (string, error) {
+	var data struct {
+		ReportID string `json:"reportId"`
+	}
+	if err := json.Unmarshal(action.Data, &data); err != nil {
+		return "", fmt.Errorf("invalid action data: %w", err)
+	}
+	return data.ReportID, nil
+}
+
+// checkReportTenant makes sure a card action comes from the tenant the report was posted to
+func checkReportTenant(activity Activity, posted *PostedReport) error {
+	if activity.TenantID() != posted.Report.TenantID {
+		return fmt.Errorf("%w: report %s", errActionForbidden, posted.ID)
+	}
+	return nil
+}
+
+// loadActionReport loads the report referenced by a card action's data
+func loadActionReport(activity Activity, action CardAction) (*PostedReport, error) {
+	reportID, err := actionReportID(action)
+	if err != nil {
+		return nil, err
+	}
+
+	posted, err := reportStore.Get(reportID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load report %s: %w", reportID, err)
+	}
+	if posted == nil {
+		return nil, fmt.Errorf("report %s not found", reportID)
+	}
+	if err := checkReportTenant(activity, posted); err != nil {
+		return nil, err
+	}
+	return posted, nil
+}
+
+// refreshReportCard returns the current card of a report as seen by the requesting user
+func refreshReportCard(activity Activity, action CardAction) (map[string]interface{}, error) {
+	posted, err := loadActionReport(activity, action)
+	if err != nil {
+		return nil, err
+	}
+	return createPostedReportCard(posted, activity.From.ID), nil
+}
+
+// executeTriage applies a triage verb, updates the shared card and returns the user's view
+func executeTriage(activity Activity, action CardAction) (map[string]interface{}, error) {
+	reportID, err := actionReportID(action)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load, change and save the report in one transaction so simultaneous clicks are not lost
+	posted, err := reportStore.Update(reportID, func(posted *PostedReport) error {
+		if err := checkReportTenant(activity, posted); err != nil {
+			return err
+		}
+		return applyTriage(posted, action.Verb, activity.From)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to triage report %s: %w", reportID, err)
+	}
+	if posted == nil {
+		return nil, fmt.Errorf("report %s not found", reportID)
+	}
+	log.Printf("User %s triaged report %s: %s", activity.From.Name, posted.ID, action.Verb)
+
+	// The invoke response only refreshes the card for this user, so update it for everyone else.
+	// The update goes through the outbox so the invoke response never waits on retries or pacing.
+	if posted.ActivityID != "" {
+		err = outboundQueue.Enqueue(&Delivery{
+			ConversationID: posted.ConversationID,
+			ActivityID:     posted.ActivityID,
+			TenantID:       posted.Report.TenantID,
+			ReportID:       posted.ID,
+		})
+		if err != nil {
+			log.Printf("Failed to queue card update of report %s: %v", posted.ID, err)
+		}
+	}
+
+	return createPostedReportCard(posted, activity.From.ID), nil
+}
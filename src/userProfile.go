@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userProfileTTL = time.Hour
+
+	// Failed lookups are remembered for a short while so every message does not retry the roster call
+	userProfileFailureTTL = 5 * time.Minute
+)
+
+// Profile of a Teams user as known to the bot
+type UserProfile struct {
+	ID                string `json:"id"`
+	AADObjectID       string `json:"aadObjectId"`
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	TenantID          string `json:"tenantId"`
+}
+
+// Cached profile, or the error of a failed lookup, with its expiry time
+type cachedUserProfile struct {
+	profile   *UserProfile
+	err       error
+	expiresAt time.Time
+}
+
+// Global variables
+var (
+	userProfiles      = make(map[string]cachedUserProfile)
+	userProfilesMutex sync.RWMutex
+)
+
+// getUserProfile returns the sender's profile, falling back to what the activity carries when it cannot be resolved
+func getUserProfile(activity Activity) *UserProfile {
+	profile, err := resolveUserProfile(activity)
+	if err != nil {
+		return &UserProfile{
+			ID:          activity.From.ID,
+			AADObjectID: activity.From.AADObjectID,
+			Name:        activity.From.Name,
+			TenantID:    activity.TenantID(),
+		}
+	}
+	return profile
+}
+
+// resolveUserProfile looks up the sender of an activity
+func resolveUserProfile(activity Activity) (*UserProfile, error) {
+	return lookupUserProfile(activity.Conversation.ID, activity.TenantID(), activity.From.ID)
+}
+
+// lookupUserProfile looks up a member of a conversation, caching the result per user ID.
+// Failures are logged once and cached for userProfileFailureTTL.
+func lookupUserProfile(conversationID, tenantID, userID string) (*UserProfile, error) {
+	userProfilesMutex.RLock()
+	cached, ok := userProfiles[userID]
+	userProfilesMutex.RUnlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.profile, cached.err
+	}
+
+	profile, err := fetchConversationMember(conversationID, userID)
+	if err != nil {
+		log.Printf("Failed to resolve profile of user %s: %v", userID, err)
+		userProfilesMutex.Lock()
+		userProfiles[userID] = cachedUserProfile{err: err, expiresAt: time.Now().Add(userProfileFailureTTL)}
+		userProfilesMutex.Unlock()
+		return nil, err
+	}
+	if profile.TenantID == "" {
+		profile.TenantID = tenantID
+	}
+
+	// Teams only returns an email for some accounts, so ask Graph for the rest
+	if profile.Email == "" && profile.AADObjectID != "" {
+		err := fillProfileFromGraph(profile)
+		if err != nil {
+			log.Printf("Failed to look up user %s in Graph: %v", profile.AADObjectID, err)
+		}
+	}
+
+	userProfilesMutex.Lock()
+	userProfiles[userID] = cachedUserProfile{profile: profile, expiresAt: time.Now().Add(userProfileTTL)}
+	userProfilesMutex.Unlock()
+
+	return profile, nil
+}
+
+// fetchConversationMember gets a member of a conversation from the Bot Connector
+func fetchConversationMember(conversationID, userID string) (*UserProfile, error) {
+	memberURL := fmt.Sprintf("%s/v3/conversations/%s/members/%s",
+		strings.TrimSuffix(getServiceURL(conversationID), "/"), conversationID, url.PathEscape(userID))
+
+	body, err := botConnectorRequest("GET", memberURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation member: %w", err)
+	}
+
+	var profile UserProfile
+	err = json.Unmarshal(body, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode conversation member: %w", err)
+	}
+	return &profile, nil
+}
+
+// fillProfileFromGraph completes a profile from Graph /users using the tenant's stored token
+func fillProfileFromGraph(profile *UserProfile) error {
+	var user struct {
+		DisplayName       string `json:"displayName"`
+		Mail              string `json:"mail"`
+		UserPrincipalName string `json:"userPrincipalName"`
+	}
+	client, err := newTenantGraphClient(profile.TenantID)
+	if err != nil {
+		return err
+	}
+	err = client.Get("/users/"+profile.AADObjectID+"?$select=displayName,mail,userPrincipalName", &user)
+	if err != nil {
+		return err
+	}
+
+	profile.Email = user.Mail
+	if profile.Email == "" {
+		profile.Email = user.UserPrincipalName
+	}
+	if profile.UserPrincipalName == "" {
+		profile.UserPrincipalName = user.UserPrincipalName
+	}
+	if profile.Name == "" {
+		profile.Name = user.DisplayName
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLookupUserProfileCachesResults(t *testing.T) {
+	useTestBotToken(t)
+	useFastRetries(t)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/v3/conversations/profile-conversation/members/missing-user" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"id": "known-user", "name": "Ada", "email": "ada@example.com"}`)
+	}))
+	defer server.Close()
+
+	rememberConversationServiceURL("profile-conversation", server.URL)
+	t.Cleanup(func() {
+		userProfilesMutex.Lock()
+		delete(userProfiles, "known-user")
+		delete(userProfiles, "missing-user")
+		userProfilesMutex.Unlock()
+	})
+
+	for i := 0; i < 2; i++ {
+		profile, err := lookupUserProfile("profile-conversation", "tenant-1", "known-user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile.Email != "ada@example.com" || profile.TenantID != "tenant-1" {
+			t.Errorf("unexpected profile %+v", profile)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the profile to be fetched once, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	for i := 0; i < 2; i++ {
+		if _, err := lookupUserProfile("profile-conversation", "tenant-1", "missing-user"); err == nil {
+			t.Fatal("expected the lookup to fail")
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected the failed lookup to be cached, got %d calls", calls.Load())
+	}
+}
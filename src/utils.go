@@ -1,18 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
@@ -28,11 +28,11 @@ func GenerateSecureKey(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(key), nil
 }
 
-// generateSessionID creates a unique session identifier
-func generateSessionID() string {
+// generateID creates a random identifier that is safe to use in URLs
+func generateID() string {
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
-		log.Fatalf("Failed to generate session ID: %v", err)
+		log.Fatalf("Failed to generate ID: %v", err)
 	}
 	return hex.EncodeToString(bytes)
 }
@@ -47,10 +47,21 @@ func clearAuthSessionCookie(w http.ResponseWriter) {
 	})
 }
 
-// startNewAuthSession initiates a new authentication session
+// startNewAuthSession initiates a new authentication session with a fresh state and PKCE verifier
 func startNewAuthSession(session *sessions.Session, r *http.Request, w http.ResponseWriter) {
-	// Clear the existing session
-	session.Options.MaxAge = -1
+	state, err := GenerateSecureKey(32)
+	if err != nil {
+		log.Printf("Failed to generate OAuth state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// Replace anything left over from a previous login
+	session.Values = make(map[interface{}]interface{})
+	session.Values["oauthState"] = state
+	session.Values["pkceVerifier"] = verifier
+	session.Values["oauthStateExpiry"] = time.Now().Add(oauthStateTTL).Unix()
 	if err := session.Save(r, w); err != nil {
 		log.Printf("Failed to save session: %v", err)
 		http.Error(w, "Failed to save session", http.StatusInternalServerError)
@@ -58,10 +69,54 @@ func startNewAuthSession(session *sessions.Session, r *http.Request, w http.Resp
 	}
 
 	// Redirect to OAuth provider
-	url := oauthConfig.AuthCodeURL("", oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	url := oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"), oauth2.S256ChallengeOption(verifier))
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+// consumeOAuthState checks the state returned by the OAuth provider and returns the PKCE verifier.
+// The state is removed from the session so it can only be used once.
+func consumeOAuthState(session *sessions.Session, r *http.Request, w http.ResponseWriter) (string, error) {
+	expected, _ := session.Values["oauthState"].(string)
+	verifier, _ := session.Values["pkceVerifier"].(string)
+	expiry, _ := session.Values["oauthStateExpiry"].(int64)
+
+	delete(session.Values, "oauthState")
+	delete(session.Values, "pkceVerifier")
+	delete(session.Values, "oauthStateExpiry")
+	if err := session.Save(r, w); err != nil {
+		return "", fmt.Errorf("failed to save session: %w", err)
+	}
+
+	if expected == "" || verifier == "" {
+		return "", fmt.Errorf("no login is in progress for this session")
+	}
+	if time.Now().After(time.Unix(expiry, 0)) {
+		return "", fmt.Errorf("the login request has expired")
+	}
+	state := r.URL.Query().Get("state")
+	if subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		return "", fmt.Errorf("the login state does not match")
+	}
+
+	return verifier, nil
+}
+
+// renderAuthError shows an error page with a link to start the login again
+func renderAuthError(w http.ResponseWriter, status int, message string) {
+	tmpl := template.Must(template.New("authError").Parse(`
+        <html>
+            <body>
+                <h1>Login failed</h1>
+                <p>{{.}}</p>
+                <a href="/login">Try again</a>
+            </body>
+        </html>
+        `))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tmpl.Execute(w, message)
+}
+
 // handleOAuthError checks for and handles OAuth errors in the request
 func handleOAuthError(r *http.Request, w http.ResponseWriter) bool {
 	if err := r.URL.Query().Get("error"); err != "" {
@@ -76,21 +131,20 @@ func handleOAuthError(r *http.Request, w http.ResponseWriter) bool {
 	return false
 }
 
-// exchangeToken exchanges the OAuth code for a token
-func exchangeToken(r *http.Request) (*oauth2.Token, error) {
+// exchangeToken exchanges the OAuth code for a token using the PKCE verifier
+func exchangeToken(r *http.Request, verifier string) (*oauth2.Token, error) {
 	ctx := context.Background()
 	code := r.URL.Query().Get("code")
-	return oauthConfig.Exchange(ctx, code)
+	return oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
 }
 
-// storeTokenInSession saves the OAuth token in the session
-func storeTokenInSession(session *sessions.Session, r *http.Request, w http.ResponseWriter, token *oauth2.Token) error {
-	sessionID := generateSessionID()
-	tokenStoreMu.Lock()
-	tokenStore[sessionID] = token.AccessToken
-	tokenStoreMu.Unlock()
+// storeTokenInSession saves the full OAuth token in the token store and its key in the session
+func storeTokenInSession(session *sessions.Session, r *http.Request, w http.ResponseWriter, key string, token *oauth2.Token) error {
+	if err := tokenStore.Save(key, token); err != nil {
+		return err
+	}
 
-	session.Values["sessionID"] = sessionID
+	session.Values["tokenKey"] = key
 	if err := session.Save(r, w); err != nil {
 		return err
 	}
@@ -144,45 +198,17 @@ func updateEnvFile(envVars map[string]string) error {
 }
 
 // checkTeamExists verifies if a team with the given name exists
-func checkTeamExists(token, teamName string) (bool, string, error) {
-	url := fmt.Sprintf("%s/me/joinedTeams", graphAPIBaseURL)
-
-	fmt.Printf("Fetching user's teams with URL: %s\n", url)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return false, "", fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	fmt.Printf("Response status: %d\nResponse body: %s\n", resp.StatusCode, string(body))
-
-	if resp.StatusCode != http.StatusOK {
-		return false, "", fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+func checkTeamExists(client *GraphClient, teamName string) (bool, string, error) {
+	var teams []struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"displayName"`
 	}
-
-	var result struct {
-		Value []struct {
-			ID          string `json:"id"`
-			DisplayName string `json:"displayName"`
-		} `json:"value"`
-	}
-	err = json.NewDecoder(bytes.NewReader(body)).Decode(&result)
+	err := client.GetAll("/me/joinedTeams", &teams)
 	if err != nil {
-		return false, "", fmt.Errorf("failed to decode response: %w", err)
+		return false, "", fmt.Errorf("failed to list joined teams: %w", err)
 	}
 
-	for _, team := range result.Value {
+	for _, team := range teams {
 		if team.DisplayName == teamName {
 			return true, team.ID, nil
 		}
@@ -196,64 +222,3 @@ func sendWelcomeMessage(channelID string) error {
 	message := "Welcome to the **Culminate Security Reports Channel**, we will send you once an investigation reports in this channel.\n\nIf you have any questions, send our virtual assistant a direct chat message!"
 	return sendBotMessage(channelID, message)
 }
-
-// listApps retrieves a list of installed Teams apps
-func listApps(token string) ([]struct {
-	ID          string `json:"id"`
-	DisplayName string `json:"displayName"`
-}, error) {
-	url := fmt.Sprintf("%s/appCatalogs/teamsApps", graphAPIBaseURL)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	var result struct {
-		Value []struct {
-			ID          string `json:"id"`
-			DisplayName string `json:"displayName"`
-		} `json:"value"`
-	}
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return result.Value, nil
-}
-
-// deleteApp removes a Teams app with the given ID
-func deleteApp(token, appID string) error {
-	url := fmt.Sprintf("%s/appCatalogs/teamsApps/%s", graphAPIBaseURL, appID)
-
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create delete request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send delete request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("failed to delete app, status code: %d", resp.StatusCode)
-	}
-
-	return nil
-}
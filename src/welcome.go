@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// handleConversationUpdate welcomes users and teams when the bot is added to their conversation
+func handleConversationUpdate(activity Activity) *InvokeResponse {
+	for _, member := range activity.MembersAdded {
+		log.Printf("Member %s added to conversation %s", member.ID, activity.Conversation.ID)
+	}
+	for _, member := range activity.MembersRemoved {
+		log.Printf("Member %s removed from conversation %s", member.ID, activity.Conversation.ID)
+	}
+
+	if len(activity.MembersAdded) > 0 {
+		welcomeConversation(activity)
+	}
+	return nil
+}
+
+// handleInstallationUpdate welcomes users and teams when the bot is installed
+func handleInstallationUpdate(activity Activity) *InvokeResponse {
+	log.Printf("Bot installation %s in conversation %s by %s", activity.Action, activity.Conversation.ID, activity.From.Name)
+
+	if activity.Action == "add" || activity.Action == "add-upgrade" {
+		welcomeConversation(activity)
+	}
+	return nil
+}
+
+// welcomeConversation greets a personal chat or team the first time the bot meets it
+func welcomeConversation(activity Activity) {
+	if activity.Conversation.ConversationType == "personal" {
+		welcomeUser(activity)
+		return
+	}
+
+	// In a team only greet when the bot itself was added, not for every new team member
+	botAdded := activity.Type == activityTypeInstallationUpdate
+	for _, member := range activity.MembersAdded {
+		if member.ID == activity.Recipient.ID {
+			botAdded = true
+		}
+	}
+	if !botAdded || activity.ChannelData.Team.ID == "" {
+		return
+	}
+
+	// Setup knows the team by its Graph ID, which Teams sends as aadGroupId
+	teamID := activity.ChannelData.Team.AADGroupID
+	if teamID == "" {
+		teamID = activity.ChannelData.Team.ID
+	}
+	key := teamWelcomeKey(teamID)
+
+	first, err := contactStore.MarkWelcomed(&Contact{
+		Key:            key,
+		Name:           activity.ChannelData.Team.Name,
+		ConversationID: activity.Conversation.ID,
+		TenantID:       activity.TenantID(),
+		WelcomedAt:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record welcome of team %s: %v", teamID, err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	err = sendWelcomeMessage(activity.Conversation.ID)
+	if err != nil {
+		log.Printf("Failed to send welcome message to team %s: %v", teamID, err)
+		forgetWelcome(key)
+	}
+}
+
+// teamWelcomeKey is the contact record marking that a team was greeted, keyed by the team's Graph ID
+func teamWelcomeKey(teamID string) string {
+	return "team:" + teamID
+}
+
+// welcomeUser sends the greeting and welcome card to a user, once. It reports whether the user was welcomed now.
+func welcomeUser(activity Activity) bool {
+	conversationID := activity.Conversation.ID
+	userName := getUserProfile(activity).Name
+
+	first, err := contactStore.MarkWelcomed(&Contact{
+		Key:            "user:" + activity.From.ID,
+		Name:           userName,
+		ConversationID: conversationID,
+		TenantID:       activity.TenantID(),
+		WelcomedAt:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record welcome of user %s: %v", userName, err)
+		return false
+	}
+	if !first {
+		return false
+	}
+
+	// Send personalized welcome message
+	welcomeMessage := fmt.Sprintf("Hello **%s**, I hope you are having a great day!\n\n I am Culminate Security's virtual assistant and I am here to respond to any questions you have.", userName)
+	err = sendBotMessage(conversationID, welcomeMessage)
+	if err != nil {
+		log.Printf("Failed to send welcome message to user %s: %v", userName, err)
+		forgetWelcome("user:" + activity.From.ID)
+		return false
+	}
+
+	offerWelcomeCard(activity)
+	return true
+}
+
+// forgetWelcome undoes the welcome mark after a failed send, so the next activity tries again.
+// The mark is taken before sending so simultaneous activities cannot both send a welcome.
+func forgetWelcome(key string) {
+	err := contactStore.UnmarkWelcomed(key)
+	if err != nil {
+		log.Printf("Failed to reset welcome of %s: %v", key, err)
+	}
+}
+
+// offerWelcomeCard sends the question card, unless the user already has an open case
+func offerWelcomeCard(activity Activity) {
+	openCase, err := messageStore.OpenCase(activity.Conversation.ID)
+	if err != nil {
+		log.Printf("Failed to look up open case: %v", err)
+	}
+	if openCase != 0 {
+		return
+	}
+
+	err = sendWelcomeCardToConversation(activity.Conversation.ID, activity.From.Name)
+	if err != nil {
+		log.Printf("Failed to send welcome card to user %s: %v", activity.From.Name, err)
+	}
+}